@@ -0,0 +1,264 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The account data event types the state of fallacy is kept in.
+const (
+	// the global key-value state in the user account data
+	accountStateType = "io.github.qua3k.fallacy.state"
+	// the moderation history in the user account data
+	accountHistoryType = "io.github.qua3k.fallacy.history"
+	// the settings of a room in its room account data
+	accountSettingsType = "io.github.qua3k.fallacy.settings"
+)
+
+// roomSettingsType is the event type of the settings in room account data.
+var roomSettingsType = event.Type{Type: accountSettingsType, Class: event.AccountDataEventType}
+
+func init() {
+	// the syncer drops events with content it can't parse
+	event.TypeMap[roomSettingsType] = reflect.TypeOf(RoomConfig{})
+}
+
+const (
+	// the amount of history records kept in the account data, oldest are
+	// dropped first
+	maxAccountHistory = 500
+	// how long changed values and history records are batched before being
+	// written, as every write wakes up the sync of fallacy
+	accountFlushDelay = 30 * time.Second
+)
+
+// accountState is the content of the state account data event.
+type accountState struct {
+	Values map[string]string `json:"values"`
+}
+
+// accountHistory is the content of the history account data event.
+type accountHistory struct {
+	Records []Record `json:"records"`
+}
+
+// accountStore is a Store keeping the state of fallacy in the account data of
+// its own account, needing no database. The values and history are written in
+// batches, the room settings are fetched on first use.
+type accountStore struct {
+	client *mautrix.Client
+	logger *slog.Logger
+
+	mu sync.Mutex
+	// whether the state and history have been fetched
+	loaded  bool
+	state   accountState
+	history accountHistory
+	// whether the values and the history changed since they were last written
+	dirty, historyDirty bool
+	flush               *time.Timer
+	// the settings of rooms fetched so far
+	rooms map[id.RoomID]RoomConfig
+}
+
+func newAccountStore(client *mautrix.Client, logger *slog.Logger) *accountStore {
+	return &accountStore{
+		client: client,
+		logger: logger,
+		rooms:  make(map[id.RoomID]RoomConfig),
+	}
+}
+
+// ignoreNotFound returns nil if err is caused by missing account data.
+func ignoreNotFound(err error) error {
+	if errors.Is(err, mautrix.MNotFound) {
+		return nil
+	}
+	return err
+}
+
+// load fetches the state and history once. The lock must be held.
+func (s *accountStore) load() error {
+	if s.loaded {
+		return nil
+	}
+
+	var (
+		state   accountState
+		history accountHistory
+	)
+	if err := ignoreNotFound(s.client.GetAccountData(accountStateType, &state)); err != nil {
+		return err
+	}
+	if err := ignoreNotFound(s.client.GetAccountData(accountHistoryType, &history)); err != nil {
+		return err
+	}
+	if state.Values == nil {
+		state.Values = make(map[string]string)
+	}
+	s.state, s.history, s.loaded = state, history, true
+	return nil
+}
+
+// write writes the values and history if they changed. The lock must be held.
+func (s *accountStore) write() error {
+	if s.flush != nil {
+		s.flush.Stop()
+		s.flush = nil
+	}
+	if s.dirty {
+		if err := s.client.SetAccountData(accountStateType, &s.state); err != nil {
+			return err
+		}
+		s.dirty = false
+	}
+	if s.historyDirty {
+		if err := s.client.SetAccountData(accountHistoryType, &s.history); err != nil {
+			return err
+		}
+		s.historyDirty = false
+	}
+	return nil
+}
+
+// schedule writes the changes within accountFlushDelay. The lock must be held.
+func (s *accountStore) schedule() {
+	if s.flush != nil {
+		return
+	}
+	s.flush = time.AfterFunc(accountFlushDelay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.write(); err != nil {
+			s.logger.Error("writing state to account data failed", "error", err)
+		}
+	})
+}
+
+// AddRecord adds a record to the history, which is written within
+// accountFlushDelay.
+func (s *accountStore) AddRecord(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	records := append(s.history.Records, r)
+	if len(records) > maxAccountHistory {
+		records = records[len(records)-maxAccountHistory:]
+	}
+	s.history.Records = records
+	s.historyDirty = true
+	s.schedule()
+	return nil
+}
+
+func (s *accountStore) History(user id.UserID, limit int) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	var r []Record
+	for _, rec := range s.history.Records {
+		if rec.Target == user.String() {
+			r = append(r, rec)
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].Time.After(r[j].Time) })
+	if limit > 0 && len(r) > limit {
+		r = r[:limit]
+	}
+	return r, nil
+}
+
+func (s *accountStore) Ping(ctx context.Context) error {
+	_, err := s.client.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          s.client.BuildClientURL("v3", "account", "whoami"),
+		ResponseJSON: &mautrix.RespWhoami{},
+		Context:      ctx,
+	})
+	return err
+}
+
+// Close writes the values and history changed since they were last written.
+func (s *accountStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write()
+}
+
+func (s *accountStore) Value(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", err
+	}
+	return s.state.Values[key], nil
+}
+
+// SetValue sets the value of the key, which is written within
+// accountFlushDelay.
+func (s *accountStore) SetValue(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	if s.state.Values[key] == value {
+		return nil
+	}
+	s.state.Values[key] = value
+	s.dirty = true
+	s.schedule()
+	return nil
+}
+
+// RoomSettings returns the settings of the room, fetching them without
+// holding the lock on first use.
+func (s *accountStore) RoomSettings(roomID id.RoomID) (RoomConfig, error) {
+	s.mu.Lock()
+	c, ok := s.rooms[roomID]
+	s.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	if err := ignoreNotFound(s.client.GetRoomAccountData(roomID, accountSettingsType, &c)); err != nil {
+		return RoomConfig{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the settings synced in the meantime are newer
+	if cached, ok := s.rooms[roomID]; ok {
+		return cached, nil
+	}
+	s.rooms[roomID] = c
+	return c, nil
+}
+
+// setRoomSettings replaces the cached settings of a room.
+func (s *accountStore) setRoomSettings(roomID id.RoomID, c RoomConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms[roomID] = c
+}
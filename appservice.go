@@ -0,0 +1,197 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+)
+
+// Appservice configures running fallacy as an application service, receiving
+// events through transactions pushed by the homeserver instead of syncing.
+type Appservice struct {
+	// the path of the registration file, omit to sync as a normal user
+	Registration string
+	// the URL the homeserver reaches the HTTP listener at
+	URL string
+	// the ID of the appservice, defaults to fallacy
+	ID string
+}
+
+// lastTxnKey is the key of the ID of the last transaction processed.
+const lastTxnKey = "appservice/last_txn"
+
+// GenerateRegistration writes a new registration of the appservice to the
+// configured path, which must then be added to the homeserver configuration.
+func (c Config) GenerateRegistration() error {
+	a := c.Appservice
+	if a.Registration == "" {
+		return errors.New("no registration path is configured")
+	}
+
+	localpart, _, err := c.Username.Parse()
+	if err != nil {
+		return err
+	}
+
+	reg := appservice.CreateRegistration()
+	reg.ID = a.ID
+	if reg.ID == "" {
+		reg.ID = "fallacy"
+	}
+	reg.URL = a.URL
+	reg.SenderLocalpart = localpart
+	rateLimited := false
+	reg.RateLimited = &rateLimited
+	reg.Namespaces.RegisterUserIDs(regexp.MustCompile(regexp.QuoteMeta(c.Username.String())), true)
+	return reg.Save(a.Registration)
+}
+
+// appserviceLogin makes the client act as the sender of the appservice,
+// registering it if it doesn't exist yet.
+func (b *Bot) appserviceLogin() error {
+	c := b.config
+	reg, err := appservice.LoadRegistration(c.Appservice.Registration)
+	if err != nil {
+		return err
+	}
+
+	b.Client.SetCredentials(c.Username, reg.AppToken)
+	_, _, err = b.Client.Register(&mautrix.ReqRegister{
+		Username:     reg.SenderLocalpart,
+		InhibitLogin: true,
+		Type:         mautrix.AuthTypeAppservice,
+	})
+	if err != nil && !errors.Is(err, mautrix.MUserInUse) {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.registration = reg
+	return nil
+}
+
+// transaction is a transaction of events pushed by the homeserver.
+type transaction struct {
+	Events []*event.Event `json:"events"`
+}
+
+// transactionSource returns the source an event pushed in a transaction would
+// have been synced from. Transactions only carry timeline events, the
+// membership of fallacy itself telling whether it is joined to the room.
+func (b *Bot) transactionSource(ev *event.Event) mautrix.EventSource {
+	if ev.Type.Type == event.StateMember.Type && ev.GetStateKey() == b.Client.UserID.String() {
+		switch m, _ := ev.Content.Raw["membership"].(string); event.Membership(m) {
+		case event.MembershipInvite:
+			return mautrix.EventSourceInvite | mautrix.EventSourceState
+		case event.MembershipLeave, event.MembershipBan:
+			return mautrix.EventSourceLeave | mautrix.EventSourceTimeline
+		}
+	}
+	return mautrix.EventSourceJoin | mautrix.EventSourceTimeline
+}
+
+// writeError writes a Matrix error response.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(mautrix.RespError{ErrCode: code, Err: msg})
+}
+
+// serveTransaction handles a transaction pushed by the homeserver, passing
+// its events to the listeners as if they were synced.
+func (s *Syncer) serveTransaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "M_UNRECOGNIZED", "method not allowed")
+		return
+	}
+
+	token := r.URL.Query().Get("access_token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	b := s.bot
+	b.lock.RLock()
+	reg := b.registration
+	b.lock.RUnlock()
+	if subtle.ConstantTimeCompare([]byte(token), []byte(reg.ServerToken)) != 1 {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "bad hs_token")
+		return
+	}
+
+	txnID := path.Base(r.URL.Path)
+	if last, _ := b.store.Value(lastTxnKey); last == txnID {
+		w.Write([]byte("{}"))
+		return
+	}
+
+	var txn transaction
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		writeError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+
+	// the homeserver retries the transaction once fallacy is back
+	if !b.begin() {
+		writeError(w, http.StatusServiceUnavailable, "M_UNKNOWN", "shutting down")
+		return
+	}
+	defer b.end()
+
+	b.setSynced()
+	for _, ev := range txn.Events {
+		// the homeserver pushes the events of every room fallacy is in
+		if !b.permitted(ev.RoomID) {
+			continue
+		}
+		s.processSyncEvent(ev.RoomID, ev, b.transactionSource(ev), nil)
+	}
+
+	if err := b.store.SetValue(lastTxnKey, txnID); err != nil {
+		b.logger.Error("saving transaction ID failed", "txn", txnID, "error", err)
+	}
+	w.Write([]byte("{}"))
+}
+
+// Run passes the events received to the listeners of the syncer until it
+// fails or the bot is shut down, returning nil in the latter case. In
+// appservice mode the events are pushed by the homeserver, otherwise
+// they are synced.
+func (b *Bot) Run(s *Syncer) error {
+	b.Client.Syncer = s
+
+	b.lock.RLock()
+	reg := b.registration
+	b.lock.RUnlock()
+	if reg == nil {
+		ctx, ok := b.syncContext()
+		if !ok {
+			return nil
+		}
+		err := b.Client.SyncWithContext(ctx)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		return err
+	}
+
+	b.mux.HandleFunc("/_matrix/app/v1/transactions/", s.serveTransaction)
+	b.mux.HandleFunc("/transactions/", s.serveTransaction)
+	if err := <-b.httpErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
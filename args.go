@@ -0,0 +1,217 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Arg declares a positional argument of a command.
+type Arg struct {
+	// the name of the argument, shown in usage messages
+	Name string
+	// whether the argument may be omitted
+	Optional bool
+}
+
+// Flag declares a flag of a command, passed as --name or -s.
+type Flag struct {
+	// the long name of the flag
+	Name string
+	// the optional one letter short name of the flag
+	Short rune
+	// whether the flag takes a value, otherwise it is a boolean switch
+	Value bool
+	// a short description of the flag, shown in help
+	Usage string
+}
+
+// Args is a parsed command line.
+type Args struct {
+	// the positional arguments, in the order they were declared
+	Positional []string
+	// the passed flags keyed by their long name, boolean flags map to ""
+	Flags map[string]string
+	// the trailing free-text reason
+	Reason string
+}
+
+// Arg returns the i-th positional argument or the empty string if it was
+// omitted.
+func (a Args) Arg(i int) string {
+	if i < len(a.Positional) {
+		return a.Positional[i]
+	}
+	return ""
+}
+
+// Flag returns the value of a flag and whether it was passed.
+func (a Args) Flag(name string) (v string, ok bool) {
+	v, ok = a.Flags[name]
+	return
+}
+
+// Has returns whether a flag was passed.
+func (a Args) Has(name string) bool {
+	_, ok := a.Flags[name]
+	return ok
+}
+
+var (
+	errUnterminated = errors.New("unterminated quoted string")
+	errTooMany      = errors.New("too many arguments")
+)
+
+// tokenize splits a line into words, treating double quoted strings as a single
+// word. Within quotes, a backslash escapes the next character.
+func tokenize(line string) (tokens []string, err error) {
+	var (
+		b      strings.Builder
+		inWord bool
+		quoted bool
+		escape bool
+	)
+	for _, r := range line {
+		switch {
+		case escape:
+			b.WriteRune(r)
+			escape = false
+		case quoted && r == '\\':
+			escape = true
+		case r == '"' && (quoted || !inWord):
+			quoted = !quoted
+			inWord = true
+		case !quoted && unicode.IsSpace(r):
+			if inWord {
+				tokens = append(tokens, b.String())
+				b.Reset()
+				inWord = false
+			}
+		default:
+			b.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, errUnterminated
+	}
+	if inWord {
+		tokens = append(tokens, b.String())
+	}
+	return
+}
+
+// lookup returns the declared flag matching a long or short name.
+func (c Callback) lookup(name string, short rune) (Flag, bool) {
+	for _, f := range c.Flags {
+		if (name != "" && f.Name == name) || (short != 0 && f.Short == short) {
+			return f, true
+		}
+	}
+	return Flag{}, false
+}
+
+// min returns the amount of required positional arguments.
+func (c Callback) min() (n int) {
+	for _, a := range c.Args {
+		if !a.Optional {
+			n++
+		}
+	}
+	return
+}
+
+// isNumber returns whether a word is a number, such as a negative count, rather
+// than a flag.
+func isNumber(w string) bool {
+	_, err := strconv.ParseFloat(w, 64)
+	return err == nil
+}
+
+// parse parses the words following the command keyword according to the
+// arguments and flags the callback declares. Flags may appear anywhere before
+// a "--" word or the reason; words after the positional arguments form the
+// reason, taken literally.
+func (c Callback) parse(words []string) (Args, error) {
+	args := Args{Flags: make(map[string]string)}
+
+	var reason []string
+	var literal bool
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+
+		var (
+			f     Flag
+			ok    bool
+			value *string
+		)
+		switch {
+		case literal || reason != nil || len(w) < 2 || w[0] != '-' || isNumber(w):
+		case w == "--":
+			literal = true
+			continue
+		case strings.HasPrefix(w, "--"):
+			name := w[2:]
+			if n, v, found := strings.Cut(name, "="); found {
+				name, value = n, &v
+			}
+			if f, ok = c.lookup(name, 0); !ok {
+				return args, errors.New("unknown flag --" + name)
+			}
+		default:
+			shorts := []rune(w[1:])
+			for j, s := range shorts {
+				if f, ok = c.lookup("", s); !ok {
+					return args, errors.New("unknown flag -" + string(s))
+				}
+				// only the last flag of a group may take a value
+				if f.Value && j != len(shorts)-1 {
+					return args, errors.New("flag -" + string(s) + " requires a value")
+				}
+				if !f.Value {
+					args.Flags[f.Name] = ""
+				}
+			}
+			if !f.Value {
+				continue
+			}
+		}
+
+		if !ok {
+			if len(args.Positional) < len(c.Args) && reason == nil {
+				args.Positional = append(args.Positional, w)
+				continue
+			}
+			if !c.Reason {
+				return args, errTooMany
+			}
+			reason = append(reason, w)
+			continue
+		}
+
+		switch {
+		case !f.Value && value != nil:
+			return args, errors.New("flag --" + f.Name + " does not take a value")
+		case !f.Value:
+			args.Flags[f.Name] = ""
+		case value != nil:
+			args.Flags[f.Name] = *value
+		case i+1 < len(words):
+			i++
+			args.Flags[f.Name] = words[i]
+		default:
+			return args, errors.New("flag --" + f.Name + " requires a value")
+		}
+	}
+
+	if len(args.Positional) < c.min() {
+		return args, errors.New("not enough arguments!")
+	}
+	args.Reason = strings.Join(reason, " ")
+	return args, nil
+}
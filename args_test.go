@@ -0,0 +1,170 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		err  error
+	}{
+		{"ban @u:example.org", []string{"ban", "@u:example.org"}, nil},
+		{"  ban \t @u:example.org  ", []string{"ban", "@u:example.org"}, nil},
+		{`ban @u:example.org "spamming links"`, []string{"ban", "@u:example.org", "spamming links"}, nil},
+		{`say "a \"quoted\" word"`, []string{"say", `a "quoted" word`}, nil},
+		{`say "back\\slash"`, []string{"say", `back\slash`}, nil},
+		{`say ""`, []string{"say", ""}, nil},
+		{`say a\ b`, []string{"say", `a\`, "b"}, nil},
+		{`say it"s fine"`, []string{"say", `it"s`, `fine"`}, nil},
+		{`say "unterminated`, nil, errUnterminated},
+		{"", nil, nil},
+	}
+	for _, tt := range tests {
+		got, err := tokenize(tt.line)
+		if err != tt.err {
+			t.Errorf("tokenize(%q) error = %v, want %v", tt.line, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	c := Callback{
+		Args: []Arg{{Name: "mxid"}, {Name: "count", Optional: true}},
+		Flags: []Flag{
+			{Name: "ban", Short: 'b'},
+			{Name: "limit", Short: 'l', Value: true},
+		},
+		Reason: true,
+	}
+	noReason := Callback{Args: []Arg{{Name: "mxid"}}}
+
+	tests := []struct {
+		name  string
+		c     Callback
+		words []string
+		want  Args
+		fails bool
+	}{
+		{
+			name:  "positional",
+			c:     c,
+			words: []string{"@u"},
+			want:  Args{Positional: []string{"@u"}},
+		},
+		{
+			name:  "reason",
+			c:     c,
+			words: []string{"@u", "5", "spamming", "links"},
+			want:  Args{Positional: []string{"@u", "5"}, Reason: "spamming links"},
+		},
+		{
+			name:  "negative positional",
+			c:     c,
+			words: []string{"@u", "-5"},
+			want:  Args{Positional: []string{"@u", "-5"}},
+		},
+		{
+			name:  "long flag",
+			c:     c,
+			words: []string{"--ban", "@u"},
+			want:  Args{Positional: []string{"@u"}, Flags: map[string]string{"ban": ""}},
+		},
+		{
+			name:  "short flag",
+			c:     c,
+			words: []string{"@u", "-b"},
+			want:  Args{Positional: []string{"@u"}, Flags: map[string]string{"ban": ""}},
+		},
+		{
+			name:  "flag=value",
+			c:     c,
+			words: []string{"--limit=10", "@u"},
+			want:  Args{Positional: []string{"@u"}, Flags: map[string]string{"limit": "10"}},
+		},
+		{
+			name:  "flag value",
+			c:     c,
+			words: []string{"--limit", "10", "@u"},
+			want:  Args{Positional: []string{"@u"}, Flags: map[string]string{"limit": "10"}},
+		},
+		{
+			name:  "negative flag value",
+			c:     c,
+			words: []string{"-l", "-1", "@u"},
+			want:  Args{Positional: []string{"@u"}, Flags: map[string]string{"limit": "-1"}},
+		},
+		{
+			name:  "grouped short flags",
+			c:     c,
+			words: []string{"-bl", "10", "@u"},
+			want:  Args{Positional: []string{"@u"}, Flags: map[string]string{"ban": "", "limit": "10"}},
+		},
+		{
+			name:  "flag within reason",
+			c:     c,
+			words: []string{"@u", "1", "spam", "--ban", "again"},
+			want:  Args{Positional: []string{"@u", "1"}, Reason: "spam --ban again"},
+		},
+		{
+			name:  "flag before reason",
+			c:     c,
+			words: []string{"@u", "1", "--ban", "spam"},
+			want:  Args{Positional: []string{"@u", "1"}, Flags: map[string]string{"ban": ""}, Reason: "spam"},
+		},
+		{
+			name:  "dashes within reason",
+			c:     c,
+			words: []string{"@u", "1", "spamming", "-_-"},
+			want:  Args{Positional: []string{"@u", "1"}, Reason: "spamming -_-"},
+		},
+		{
+			name:  "unknown flags within reason",
+			c:     c,
+			words: []string{"@u", "1", "see", "-x", "--foo"},
+			want:  Args{Positional: []string{"@u", "1"}, Reason: "see -x --foo"},
+		},
+		{
+			name:  "literal after --",
+			c:     c,
+			words: []string{"--", "--ban", "@u"},
+			want:  Args{Positional: []string{"--ban", "@u"}},
+		},
+		{name: "value flag within group", c: c, words: []string{"-lb", "10", "@u"}, fails: true},
+		{name: "unknown long flag", c: c, words: []string{"--nope", "@u"}, fails: true},
+		{name: "unknown short flag", c: c, words: []string{"-x", "@u"}, fails: true},
+		{name: "value of boolean flag", c: c, words: []string{"--ban=yes", "@u"}, fails: true},
+		{name: "missing flag value", c: c, words: []string{"@u", "--limit"}, fails: true},
+		{name: "missing argument", c: c, words: nil, fails: true},
+		{name: "too many arguments", c: noReason, words: []string{"@u", "extra"}, fails: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.c.parse(tt.words)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: parse(%q) succeeded, want an error", tt.name, tt.words)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parse(%q) failed: %v", tt.name, tt.words, err)
+			continue
+		}
+		if tt.want.Flags == nil {
+			tt.want.Flags = map[string]string{}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parse(%q) = %+v, want %+v", tt.name, tt.words, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"html"
+	"log/slog"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Trigger is what caused a moderation action.
+type Trigger string
+
+const (
+	TriggerCommand Trigger = "command"
+	TriggerPolicy  Trigger = "policy rule"
+	TriggerAutomod Trigger = "automod"
+	TriggerHandler Trigger = "event handler"
+)
+
+// Action is a moderation action taken by or through fallacy.
+type Action struct {
+	// the kind of action, e.g. ban, kick, mute or purge
+	Kind string
+	// the user who caused the action
+	Actor id.UserID
+	// the user, glob or server acted upon
+	Target string
+	// the room the action was taken in
+	RoomID id.RoomID
+	// the reason given for the action
+	Reason string
+	// what caused the action
+	Trigger Trigger
+	// additional details about the outcome, e.g. the amount of redactions
+	Detail string
+	// the error the action failed with, if any
+	Err error
+}
+
+// logRoomOf returns the log room of a room, or the empty string if there is
+// none.
+func (b *Bot) logRoomOf(roomID id.RoomID) id.RoomID {
+	if r := b.roomConfig(roomID).LogRoom; r != "" {
+		return r
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.logRoom
+}
+
+// userLink returns a matrix.to anchor of a user.
+func userLink(user string) string {
+	u := html.EscapeString(user)
+	return `<a href="https://matrix.to/#/` + u + `">` + u + `</a>`
+}
+
+// format returns the plain and HTML bodies of a log entry for the action.
+func (a Action) format() (plain, formatted string) {
+	outcome := "succeeded"
+	if a.Err != nil {
+		outcome = "failed: " + a.Err.Error()
+	}
+	if a.Detail != "" {
+		outcome += " (" + a.Detail + ")"
+	}
+
+	fields := [][3]string{
+		{"Actor", a.Actor.String(), userLink(a.Actor.String())},
+		{"Target", a.Target, html.EscapeString(a.Target)},
+		{"Room", a.RoomID.String(), html.EscapeString(a.RoomID.String())},
+		{"Reason", a.Reason, html.EscapeString(a.Reason)},
+		{"Trigger", string(a.Trigger), html.EscapeString(string(a.Trigger))},
+		{"Outcome", outcome, html.EscapeString(outcome)},
+	}
+	if strings.HasPrefix(a.Target, "@") && !strings.ContainsAny(a.Target, "*?") {
+		fields[1][2] = userLink(a.Target)
+	}
+
+	var p, f strings.Builder
+	p.WriteString(a.Kind + "\n")
+	f.WriteString("<b>" + html.EscapeString(a.Kind) + "</b><ul>")
+	for _, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+		p.WriteString(field[0] + ": " + field[1] + "\n")
+		f.WriteString("<li><b>" + field[0] + ":</b> " + field[2] + "</li>")
+	}
+	f.WriteString("</ul>")
+	return strings.TrimSpace(p.String()), f.String()
+}
+
+// logAction records the action in the moderation history and posts an entry
+// for it into the log room of the room it was taken in, if one is configured.
+func (b *Bot) logAction(a Action) {
+	b.recordAction(a)
+	b.postAction(a)
+}
+
+// refuse logs the action as refused with err before it was taken, returning
+// err.
+func (b *Bot) refuse(a Action, err error) error {
+	a.Err = err
+	b.logAction(a)
+	return err
+}
+
+// actionLogger returns the logger of an action.
+func (b *Bot) actionLogger(a Action) *slog.Logger {
+	return b.roomLogger(a.RoomID).With("action", a.Kind, "sender", a.Actor, "target", a.Target, "trigger", a.Trigger)
+}
+
+// recordAction records the action in the moderation history without posting
+// it into the log room, for actions summarized by a single entry.
+func (b *Bot) recordAction(a Action) {
+	moderationActions.WithLabelValues(a.Kind, result(a.Err)).Inc()
+
+	l := b.actionLogger(a)
+	if a.Err != nil {
+		l.Warn("moderation action failed", "detail", a.Detail, "error", a.Err)
+	} else {
+		l.Info("moderation action taken", "detail", a.Detail)
+	}
+	if err := b.store.AddRecord(a.record()); err != nil {
+		l.Error("recording action in history failed", "error", err)
+	}
+}
+
+// postAction posts an entry for the action into the log room of the room it
+// was taken in, if one is configured.
+func (b *Bot) postAction(a Action) {
+	roomID := b.logRoomOf(a.RoomID)
+	if roomID == "" {
+		return
+	}
+
+	plain, formatted := a.format()
+	if _, err := b.sendMessage(roomID, &event.MessageEventContent{
+		MsgType:       event.MsgNotice,
+		Body:          plain,
+		Format:        event.FormatHTML,
+		FormattedBody: formatted,
+	}); err != nil {
+		b.actionLogger(a).Error("posting action into log room failed", "log_room", roomID, "error", err)
+	}
+}
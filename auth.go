@@ -0,0 +1,302 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// credentials are the credentials of a session, saved to reuse it across
+// restarts.
+type credentials struct {
+	UserID       id.UserID   `json:"user_id"`
+	AccessToken  string      `json:"access_token"`
+	DeviceID     id.DeviceID `json:"device_id"`
+	RefreshToken string      `json:"refresh_token,omitempty"`
+}
+
+// reqLogin is a login request optionally asking for a refresh token, which
+// mautrix doesn't support yet.
+type reqLogin struct {
+	mautrix.ReqLogin
+	RefreshToken bool `json:"refresh_token,omitempty"`
+}
+
+// respLogin is the response to a login or refresh request.
+type respLogin struct {
+	mautrix.RespLogin
+	RefreshToken string `json:"refresh_token"`
+}
+
+var errNoPassword = errors.New("no password to log in with")
+
+// isLoggedOut returns whether the error is caused by an invalidated session,
+// including soft logouts.
+func isLoggedOut(err error) bool {
+	return errors.Is(err, mautrix.MUnknownToken)
+}
+
+// loadCredentials reads the credentials file at the path.
+func loadCredentials(path string) (c credentials, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &c)
+	return
+}
+
+// saveCredentials writes the credentials file at the path, readable by the
+// owner only.
+func saveCredentials(path string, c credentials) error {
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
+
+// useSession makes the client use the session, saving it to the credentials
+// file if one is configured. authLock must be held.
+func (b *Bot) useSession(c credentials) error {
+	b.Client.SetCredentials(c.UserID, c.AccessToken)
+	b.Client.DeviceID = c.DeviceID
+	b.session = c
+
+	if b.config.Credentials == "" {
+		return nil
+	}
+	return saveCredentials(b.config.Credentials, c)
+}
+
+// resume makes the client use existing credentials after checking they are
+// valid. authLock must be held.
+func (b *Bot) resume(c credentials) error {
+	b.Client.SetCredentials(c.UserID, c.AccessToken)
+	b.session = c
+
+	w, err := b.Client.Whoami()
+	if err != nil {
+		return err
+	}
+
+	c.UserID = w.UserID
+	if w.DeviceID != "" {
+		c.DeviceID = w.DeviceID
+	}
+	return b.useSession(c)
+}
+
+// passwordLogin logs in with the password of the configuration, reusing the
+// current device. authLock must be held.
+func (b *Bot) passwordLogin() error {
+	c := b.config
+	if c.Password == "" {
+		return errNoPassword
+	}
+
+	device := c.DeviceID
+	if device == "" {
+		device = b.session.DeviceID
+	}
+
+	var resp respLogin
+	_, err := b.Client.MakeFullRequest(mautrix.FullRequest{
+		Method: http.MethodPost,
+		URL:    b.Client.BuildClientURL("v3", "login"),
+		RequestJSON: &reqLogin{
+			ReqLogin: mautrix.ReqLogin{
+				DeviceID: device,
+				Identifier: mautrix.UserIdentifier{
+					User: string(c.Username),
+					Type: mautrix.IdentifierTypeUser,
+				},
+				InitialDeviceDisplayName: c.Name,
+				Password:                 c.Password,
+				Type:                     mautrix.AuthTypePassword,
+			},
+			RefreshToken: c.RefreshTokens,
+		},
+		ResponseJSON:     &resp,
+		SensitiveContent: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.useSession(credentials{
+		UserID:       resp.UserID,
+		AccessToken:  resp.AccessToken,
+		DeviceID:     resp.DeviceID,
+		RefreshToken: resp.RefreshToken,
+	})
+}
+
+// refresh exchanges the refresh token of the session for a new access token.
+// authLock must be held.
+func (b *Bot) refresh() error {
+	var resp respLogin
+	_, err := b.Client.MakeFullRequest(mautrix.FullRequest{
+		Method:           http.MethodPost,
+		URL:              b.Client.BuildClientURL("v3", "refresh"),
+		RequestJSON:      map[string]string{"refresh_token": b.session.RefreshToken},
+		ResponseJSON:     &resp,
+		SensitiveContent: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	c := b.session
+	c.AccessToken = resp.AccessToken
+	if resp.RefreshToken != "" {
+		c.RefreshToken = resp.RefreshToken
+	}
+	return b.useSession(c)
+}
+
+// login logs in with the access token of the configuration, the saved
+// credentials or the password, in that order of preference.
+func (b *Bot) login() error {
+	b.authLock.Lock()
+	defer b.authLock.Unlock()
+	c := b.config
+
+	if c.Appservice.Registration != "" {
+		return b.appserviceLogin()
+	}
+
+	if c.AccessToken != "" {
+		err := b.resume(credentials{UserID: c.Username, AccessToken: c.AccessToken, DeviceID: c.DeviceID})
+		if err == nil || !isLoggedOut(err) || c.Password == "" {
+			return err
+		}
+		b.logger.Warn("the configured access token is invalid, logging in with the password")
+		return b.passwordLogin()
+	}
+
+	if c.Credentials != "" {
+		saved, err := loadCredentials(c.Credentials)
+		switch {
+		case err == nil:
+			err = b.resume(saved)
+			if err == nil {
+				return nil
+			}
+			if !isLoggedOut(err) {
+				return err
+			}
+			if saved.RefreshToken != "" && b.refresh() == nil {
+				return nil
+			}
+		case !errors.Is(err, fs.ErrNotExist):
+			return err
+		}
+	}
+	return b.passwordLogin()
+}
+
+// relogin restores the session after the homeserver invalidated it,
+// refreshing it if possible and logging in with the password otherwise.
+func (b *Bot) relogin() error {
+	b.authLock.Lock()
+	defer b.authLock.Unlock()
+	return b.restore()
+}
+
+// renew restores the session if its access token is still stale, returning
+// the current access token. Requests failing at once thus only log in again
+// once.
+func (b *Bot) renew(stale string) (string, error) {
+	b.authLock.Lock()
+	defer b.authLock.Unlock()
+
+	if b.session.AccessToken == stale {
+		if err := b.restore(); err != nil {
+			return "", err
+		}
+	}
+	return b.session.AccessToken, nil
+}
+
+// restore refreshes the session if possible and logs in with the password
+// otherwise. authLock must be held.
+func (b *Bot) restore() error {
+	if b.session.RefreshToken != "" {
+		err := b.refresh()
+		if err == nil {
+			return nil
+		}
+		b.logger.Warn("refreshing session failed, logging in with the password", "error", err)
+	}
+	return b.passwordLogin()
+}
+
+// reauthenticator is a http.RoundTripper restoring the session when the
+// homeserver invalidated it, retrying the failed request once with the new
+// access token.
+type reauthenticator struct {
+	bot  *Bot
+	next http.RoundTripper
+}
+
+// sessionExempt returns whether a request must not restore the session, as it
+// is made while logging in or its failure is handled by the syncer.
+func sessionExempt(path string) bool {
+	for _, suffix := range []string{"/login", "/refresh", "/account/whoami", "/sync"} {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *reauthenticator) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := r.next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized ||
+		sessionExempt(req.URL.Path) || r.bot.config.Appservice.Registration != "" {
+		return res, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	var e mautrix.RespError
+	if json.Unmarshal(body, &e) != nil || e.ErrCode != mautrix.MUnknownToken.ErrCode ||
+		(req.Body != nil && req.GetBody == nil) {
+		return res, nil
+	}
+
+	r.bot.logger.Warn("session was invalidated, logging in again", "path", req.URL.Path)
+	token, err := r.bot.renew(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		r.bot.logger.Error("logging in again failed", "error", err)
+		return res, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return r.next.RoundTrip(retry)
+}
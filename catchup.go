@@ -0,0 +1,87 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// defaultCatchUp is how far back events missed while offline are processed
+// when not configured.
+const defaultCatchUp = time.Hour
+
+// catchUp is a sync handler processing the events sent while fallacy was
+// offline. The first sync resuming from a stored token is extended with the
+// events the homeserver omitted from limited timelines, and events older than
+// the catch-up window are dropped. Without a stored token the first sync is
+// not processed at all.
+func (s *Syncer) catchUp(res *mautrix.RespSync, since string) bool {
+	if s.caughtUp {
+		return true
+	}
+	s.caughtUp = true
+	if since == "" {
+		return false
+	}
+
+	s.bot.lock.RLock()
+	cutoff := time.Now().Add(-s.bot.catchUpWindow).UnixMilli()
+	s.bot.lock.RUnlock()
+
+	for roomID, room := range res.Rooms.Join {
+		if room.Timeline.Limited {
+			missed, err := s.bot.fetchGap(roomID, room.Timeline.PrevBatch, since, cutoff)
+			if err != nil {
+				s.bot.roomLogger(roomID).Warn("catching up on missed events failed", "error", err)
+			}
+			room.Timeline.Events = append(missed, room.Timeline.Events...)
+		}
+
+		events := room.Timeline.Events[:0]
+		for _, e := range room.Timeline.Events {
+			if e.Timestamp >= cutoff {
+				events = append(events, e)
+			}
+		}
+		room.Timeline.Events = events
+		res.Rooms.Join[roomID] = room
+	}
+	return true
+}
+
+// fetchGap paginates backwards from the token to the sync token, returning the
+// events in between sent after the cutoff in chronological order.
+func (b *Bot) fetchGap(roomID id.RoomID, from, to string, cutoff int64) ([]*event.Event, error) {
+	filter := mautrix.FilterPart{LazyLoadMembers: true, Types: timelineTypes}
+
+	var events []*event.Event
+	defer func() {
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+	}()
+
+	for from != "" {
+		msg, err := validate(b.Client.Messages(roomID, from, to, 'b', &filter, fetchLimit))
+		if err != nil {
+			return events, err
+		}
+		for _, e := range msg.Chunk {
+			if e.Timestamp < cutoff {
+				return events, nil
+			}
+			events = append(events, e)
+		}
+		if len(msg.Chunk) == 0 || msg.End == from {
+			break
+		}
+		from = msg.End
+	}
+	return events, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// moderatedRooms returns the rooms fallacy is joined to and permitted to act
+// in.
+func (b *Bot) moderatedRooms() ([]id.RoomID, error) {
+	resp, err := b.Client.JoinedRooms()
+	if err != nil {
+		return nil, err
+	}
+
+	var rooms []id.RoomID
+	for _, r := range resp.JoinedRooms {
+		if b.permitted(r) {
+			rooms = append(rooms, r)
+		}
+	}
+	return rooms, nil
+}
+
+// permitted returns whether fallacy may act in the room, which is every room
+// unless permitted rooms are configured.
+func (b *Bot) permitted(roomID id.RoomID) bool {
+	return len(b.permittedRooms) == 0 || slices.Contains(b.permittedRooms, roomID)
+}
+
+// canBan returns an error unless both the actor and fallacy have the ban
+// power level in the room and the target's power level is below the actor's.
+func (b *Bot) canBan(roomID id.RoomID, actor, target id.UserID) error {
+	pl, err := b.powerLevels(roomID)
+	if err != nil {
+		return Failed("fetching power levels failed", err)
+	}
+	switch {
+	case pl.GetUserLevel(b.Client.UserID) < pl.Ban():
+		return errNoPerms
+	case pl.GetUserLevel(actor) < pl.Ban():
+		return errNoBanLevel
+	case pl.GetUserLevel(target) >= pl.GetUserLevel(actor):
+		return errOutranked
+	}
+	return nil
+}
+
+// cleanupUser redacts every message sent by the target of the action in the
+// specified rooms, banning them first if ban is set. Rooms where fallacy lacks
+// the permission to redact are skipped, as are rooms where the actor may not
+// ban the target if ban is set. It returns the number of events redacted, the
+// number of rooms that were cleaned up and the errors of the rooms where the
+// ban or the purge failed.
+func (b *Bot) cleanupUser(a Action, rooms []id.RoomID, ban bool) (events, cleaned int, failed map[id.RoomID]error) {
+	user := id.UserID(a.Target)
+	failed = make(map[id.RoomID]error)
+	for _, roomID := range rooms {
+		if b.stopping() {
+			return
+		}
+		if !b.hasPerms(roomID, event.EventRedaction) {
+			continue
+		}
+		a.RoomID = roomID
+
+		var banErr error
+		if ban {
+			banned := a
+			banned.Kind = "ban"
+			if err := b.canBan(roomID, a.Actor, user); err != nil {
+				failed[roomID] = b.refuse(banned, err)
+				continue
+			}
+			_, banErr = b.Client.BanUser(roomID, &mautrix.ReqBanUser{
+				Reason: a.Reason,
+				UserID: user,
+			})
+			banned.Err = banErr
+			b.logAction(banned)
+			if banErr != nil {
+				banErr = Failed("banning failed", banErr)
+			}
+		}
+
+		n, last, err := b.purgeUser(roomID, user, purgeAll)
+		if err != nil {
+			err = Failed("purging failed", err)
+		}
+		err = errors.Join(banErr, err)
+		if err != nil {
+			b.roomLogger(roomID).Error("cleaning up user failed", "action", a.Kind, "user", user, "error", err)
+			failed[roomID] = err
+		} else {
+			cleaned++
+		}
+		a.Detail, a.Err = purgeDetail(n, last, err), err
+		b.logAction(a)
+
+		events += n
+	}
+	return
+}
+
+// cleanupPolicyUser cleans up a user banned through a moderation policy sent
+// by actor in every room fallacy moderates and the actor administers.
+func (b *Bot) cleanupPolicyUser(actor, user id.UserID) {
+	joined, err := b.moderatedRooms()
+	if err != nil {
+		b.logger.Error("fetching joined rooms failed", "action", "cleanup", "user", user, "error", err)
+		return
+	}
+	var rooms []id.RoomID
+	for _, r := range joined {
+		if b.isAdmin(r, actor) {
+			rooms = append(rooms, r)
+		}
+	}
+	b.cleanupUser(Action{
+		Kind:    "cleanup",
+		Actor:   actor,
+		Target:  user.String(),
+		Trigger: TriggerPolicy,
+	}, rooms, false)
+}
+
+// CleanupUser redacts the history of a user in every room fallacy moderates and
+// the invoker administers, optionally banning them with the --ban flag.
+func (b *Bot) CleanupUser(args Args, ev event.Event) error {
+	user := id.UserID(args.Arg(0))
+
+	if _, _, err := user.Parse(); err != nil {
+		return errNotUser
+	}
+
+	joined, err := b.moderatedRooms()
+	if err != nil {
+		return Failed("fetching joined rooms failed", err)
+	}
+
+	var rooms []id.RoomID
+	for _, r := range joined {
+		if b.isAdmin(r, ev.Sender) {
+			rooms = append(rooms, r)
+		}
+	}
+
+	events, cleaned, failed := b.cleanupUser(Action{
+		Kind:    "cleanup",
+		Actor:   ev.Sender,
+		Target:  user.String(),
+		Reason:  args.Reason,
+		Trigger: TriggerCommand,
+	}, rooms, args.Has("ban"))
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "Cleaned up %d events from %s in %d rooms!", events, user, cleaned)
+	if len(failed) > 0 {
+		fmt.Fprintf(&msg, "\nFailed in %d rooms:", len(failed))
+		for roomID, err := range failed {
+			fmt.Fprintf(&msg, "\n%s: %s", roomID, errorReply("cleanup", err))
+		}
+	}
+	b.sendNotice(ev.RoomID, msg.String())
+	return nil
+}
+
+var (
+	errNoBanLevel = Denied("banning requires the ban power level")
+	errOutranked  = Denied("the user's power level is not below yours")
+)
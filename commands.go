@@ -6,7 +6,6 @@ package fallacy
 
 import (
 	"errors"
-	"log"
 	"strings"
 
 	"github.com/gobwas/glob"
@@ -18,77 +17,141 @@ import (
 const (
 	// Message to be sent when fallacy does not have sufficient permissions.
 	permsMessage = "fallacy does not have sufficient permission to perform that action"
-
-	// Usage message to be sent when asking for help.
-	usage = "Hey, check out the usage guide at https://github.com/qua3k/fallacy/blob/main/USAGE.md"
 )
 
 var (
-	errNoPerms = errors.New(permsMessage)
+	errNoPerms = Denied(permsMessage)
+	errBusy    = Refused("too many commands are waiting in this room, try again later")
 )
 
+// Callback is a command registered under a keyword, describing itself for
+// the generated help.
 type Callback struct {
-	Function func(command []string, event event.Event)
-	Min      int
+	// Function runs the command. The returned error is reported to the
+	// invoker, see CommandError.
+	Function func(args Args, ev event.Event) error
+
+	// a one line summary of the command
+	Synopsis string
+	// the detailed description of the command as Markdown
+	Description string
+	// the permission required to run the command, defaults to PermAdmin
+	Permission Permission
+	// example invocations of the command
+	Examples []string
+
+	// the positional arguments the command takes
+	Args []Arg
+	// the flags the command accepts
+	Flags []Flag
+	// whether the command takes a trailing free-text reason
+	Reason bool
+	// the name of the reason shown in usage, defaults to "reason"
+	ReasonName string
 }
 
 // Register registers a command with a keyword.
-func Register(keyword string, callback Callback) {
-	lock.Lock()
-	defer lock.Unlock()
+func (b *Bot) Register(keyword string, callback Callback) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
 	keyword = strings.ToLower(keyword)
-	if _, ok := handles[keyword]; !ok {
-		handles[keyword] = []Callback{}
+	if _, ok := b.handles[keyword]; !ok {
+		b.handles[keyword] = []Callback{}
 	}
-	handles[keyword] = append(handles[keyword], callback)
+	b.handles[keyword] = append(b.handles[keyword], callback)
 }
 
-// notifyListeners notifies listeners of incoming events.
-func notifyListeners(command []string, ev event.Event) {
-	if len(command) < 2 || strings.EqualFold(command[1], "help") {
-		if _, err := sendReply(ev, usage); err != nil {
-			log.Println("could not send reply into room, failed with:", err)
-		}
+// notifyListeners notifies listeners of incoming events. The command starts
+// with the keyword or alias of the command, following the invocation of
+// fallacy. The command is queued to run after the other commands of its room.
+func (b *Bot) notifyListeners(command []string, ev event.Event) {
+	if len(command) < 1 {
+		command = append(command, "help")
+	}
+
+	keyword, c, ok := b.resolve(command[0])
+	if !ok {
+		b.reportError(command[0], ev, NotFound(command[0]+" is not a valid command!"))
 		return
 	}
 
-	if !isAdmin(ev.RoomID, ev.Sender) {
-		if _, err := sendReply(ev, "shut up ur not admin"); err != nil {
-			log.Println("could not send reply into room, failed with:", err)
-		}
+	pl, err := b.powerLevels(ev.RoomID)
+	if err != nil {
+		b.reportError(keyword, ev, Failed("fetching power levels failed", err))
 		return
 	}
 
-	if c, ok := handles[strings.ToLower(command[1])]; ok {
-		for i := range c {
-			args := command[2:]
-			if len(args) < c[i].Min {
-				sendNotice(ev.RoomID, "not enough arguments!")
-				continue
-			}
-			go c[i].Function(args, ev)
+	for i := range c {
+		perm := b.requiredPermission(ev.RoomID, keyword, c[i])
+		if pl.GetUserLevel(ev.Sender) < perm.Level(pl) {
+			b.reportError(keyword, ev, Denied("shut up ur not admin, "+keyword+" requires "+perm.Name))
+			continue
 		}
+
+		args, err := c[i].parse(command[1:])
+		if err != nil {
+			b.reportError(keyword, ev, BadArgs(err.Error()+" usage: "+c[i].usage(b.commandPrefix(ev.RoomID), keyword)))
+			continue
+		}
+		if b.stopping() {
+			b.reportError(keyword, ev, Refused("fallacy is shutting down, try again later"))
+			return
+		}
+		cb := c[i]
+		if !b.queueCommand(ev.RoomID, func() { b.runCommand(keyword, cb, args, ev) }) {
+			b.reportError(keyword, ev, errBusy)
+		}
+	}
+}
+
+// runCommand runs a command, reporting the error it returns.
+func (b *Bot) runCommand(keyword string, c Callback, args Args, ev event.Event) {
+	b.commandLogger(keyword, &ev).Debug("running command")
+
+	var err error
+	perr := b.protect("command "+keyword, TriggerCommand, &ev, func() {
+		err = c.Function(args, ev)
+	})
+	switch {
+	case errors.Is(perr, errDisabled):
+		err = Refused(keyword + " is " + errDisabled.Error() + ", try again later")
+	case perr != nil:
+		err = Failed(keyword+" failed", perr)
+	}
+	if err != nil {
+		b.reportError(keyword, ev, err)
 		return
 	}
-	sendNotice(ev.RoomID, command[1]+" is not a valid command!")
+	commandsExecuted.WithLabelValues(keyword, "ok").Inc()
 }
 
-// sendNotice is a wrapper around Client.SendNotice that logs when sending a
-// notice fails.
-func sendNotice(roomID id.RoomID, text ...string) (resp *mautrix.RespSendEvent) {
-	<-limit
-	resp, err := Client.SendNotice(roomID, strings.Join(text, " "))
+// sendMessage sends a message event into the room, encrypting it if the room
+// is encrypted.
+func (b *Bot) sendMessage(roomID id.RoomID, content interface{}) (*mautrix.RespSendEvent, error) {
+	t, content, err := b.encryptContent(roomID, event.EventMessage, content)
+	if err != nil {
+		return nil, err
+	}
+	return b.Client.SendMessageEvent(roomID, t, content)
+}
+
+// sendNotice is a wrapper around sendMessage that sends a notice, logging
+// when sending it fails.
+func (b *Bot) sendNotice(roomID id.RoomID, text ...string) (resp *mautrix.RespSendEvent) {
+	resp, err := b.sendMessage(roomID, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    strings.Join(text, " "),
+	})
 	if err != nil {
-		log.Println("could not send notice into room", roomID, "failed with error:", err)
+		b.roomLogger(roomID).Error("sending notice failed", "error", err)
 	}
 	return
 }
 
 // sendReply sends a message as a reply to another message.
-func sendReply(ev event.Event, s string) (*mautrix.RespSendEvent, error) {
-	<-limit
-	return Client.SendMessageEvent(ev.RoomID, event.EventMessage, &event.MessageEventContent{
+func (b *Bot) sendReply(ev event.Event, s string) (*mautrix.RespSendEvent, error) {
+	return b.sendMessage(ev.RoomID, &event.MessageEventContent{
 		MsgType: event.MsgText,
 		Body:    s,
 		RelatesTo: &event.RelatesTo{
@@ -113,10 +176,10 @@ func adminLevel(pl *event.PowerLevelsEventContent) (lvl int) {
 
 // isAdmin returns whether the user is a room admin by checking ban/kick/redact
 // power levels.
-func isAdmin(roomID id.RoomID, userID id.UserID) bool {
-	pl, err := powerLevels(roomID)
+func (b *Bot) isAdmin(roomID id.RoomID, userID id.UserID) bool {
+	pl, err := b.powerLevels(roomID)
 	if err != nil {
-		log.Println("fetching power levels event failed!")
+		b.roomLogger(roomID).Error("fetching power levels failed", "error", err)
 		return false
 	}
 
@@ -124,39 +187,38 @@ func isAdmin(roomID id.RoomID, userID id.UserID) bool {
 }
 
 // hasPerms checks whether the fallacy bot has perms.
-func hasPerms(roomID id.RoomID, event event.Type) bool {
-	pl, err := powerLevels(roomID)
+func (b *Bot) hasPerms(roomID id.RoomID, event event.Type) bool {
+	pl, err := b.powerLevels(roomID)
 	if err != nil {
-		log.Println("fetching power levels event failed with error", err)
+		b.roomLogger(roomID).Error("fetching power levels failed", "error", err)
 		return false
 	}
 
-	if pl.GetEventLevel(event) > pl.GetUserLevel(Client.UserID) {
-		return false
-	}
-	return true
+	return b.canSend(pl, event)
+}
+
+// canSend returns whether fallacy may send events of the type according to the
+// power levels.
+func (b *Bot) canSend(pl *event.PowerLevelsEventContent, t event.Type) bool {
+	return pl.GetEventLevel(t) <= pl.GetUserLevel(b.Client.UserID)
 }
 
 // BanServer bans a server by adding it to the room ACL.
-func BanServer(roomID id.RoomID, homeserver string) (err error) {
-	if !hasPerms(roomID, event.StateServerACL) {
-		sendNotice(roomID, permsMessage)
-		return
+func (b *Bot) BanServer(roomID id.RoomID, homeserver string) (err error) {
+	if !b.hasPerms(roomID, event.StateServerACL) {
+		return errNoPerms
 	}
 
 	glb, err := glob.Compile(homeserver)
 	if err != nil {
-		sendNotice(roomID, "not a valid glob pattern!")
-		return
+		return BadArgs("not a valid glob pattern!")
 	}
 
-	_, hs, _ := Client.UserID.Parse()
-	if !glb.Match(hs) {
-		sendNotice(roomID, "Refusing to ban own homeserver...")
-		return
+	if b.matchesOwnServer(glb) {
+		return Refused("Refusing to ban own homeserver...")
 	}
 
-	acls, err := acls(roomID)
+	acls, err := b.acls(roomID)
 	if err != nil {
 		return
 	}
@@ -174,81 +236,99 @@ func BanServer(roomID id.RoomID, homeserver string) (err error) {
 	}
 
 	acls.Deny = append(acls.Deny, homeserver)
-	_, err = Client.SendStateEvent(roomID, event.StateServerACL, "", &acls)
+	_, err = b.Client.SendStateEvent(roomID, event.StateServerACL, "", &acls)
 	return
 }
 
 // MuteUser mutes a target user in a specified room by utilizing power levels.
-func MuteUser(body []string, ev event.Event) {
-	pl, err := powerLevels(ev.RoomID)
+func (b *Bot) MuteUser(args Args, ev event.Event) error {
+	pl, err := b.powerLevels(ev.RoomID)
 	if err != nil {
-		log.Println(err)
-		return
+		return Failed("fetching power levels failed", err)
 	}
 
-	targetID := id.UserID(body[0])
+	targetID := id.UserID(args.Arg(0))
 
 	level := pl.GetEventLevel(event.EventMessage)
 	if pl.GetUserLevel(targetID) < level {
-		sendNotice(ev.RoomID, "cannot mute a user that is already muted")
-		return
+		return Refused("cannot mute a user that is already muted")
 	}
-	pl.SetUserLevel(targetID, level)
-	if _, err := Client.SendStateEvent(ev.RoomID, event.StatePowerLevels, "", &pl); err != nil {
-		sendNotice(ev.RoomID, "could not mute user! failed with: "+err.Error())
-		return
+	pl.SetUserLevel(targetID, level-1)
+	_, err = b.Client.SendStateEvent(ev.RoomID, event.StatePowerLevels, "", &pl)
+	b.logAction(Action{
+		Kind:    "mute",
+		Actor:   ev.Sender,
+		Target:  targetID.String(),
+		RoomID:  ev.RoomID,
+		Trigger: TriggerCommand,
+		Err:     err,
+	})
+	if err != nil {
+		return Failed("could not mute user", err)
 	}
-	msg := strings.Join([]string{body[0], "was muted by", ev.Sender.String(), "in", ev.RoomID.String()}, " ")
-	sendNotice(ev.RoomID, msg)
+	msg := strings.Join([]string{targetID.String(), "was muted by", ev.Sender.String(), "in", ev.RoomID.String()}, " ")
+	b.sendNotice(ev.RoomID, msg)
+	return nil
 }
 
 // UnmuteUser unmutes a target user in a specified room by utilizing power levels.
-func UnmuteUser(body []string, ev event.Event) {
-	pl, err := powerLevels(ev.RoomID)
+func (b *Bot) UnmuteUser(args Args, ev event.Event) error {
+	pl, err := b.powerLevels(ev.RoomID)
 	if err != nil {
-		log.Println(err)
-		return
+		return Failed("fetching power levels failed", err)
 	}
 
-	targetID := id.UserID(body[0])
+	targetID := id.UserID(args.Arg(0))
 
 	level := pl.GetEventLevel(event.EventMessage)
 	if pl.GetUserLevel(targetID) >= level {
-		sendNotice(ev.RoomID, "cannot unmute a user that is not muted")
-		return
+		return Refused("cannot unmute a user that is not muted")
 	}
 	pl.SetUserLevel(targetID, level)
-	if _, err := Client.SendStateEvent(ev.RoomID, event.StatePowerLevels, "", &pl); err != nil {
-		sendNotice(ev.RoomID, "could not unmute user! failed with: "+err.Error())
-		return
+	_, err = b.Client.SendStateEvent(ev.RoomID, event.StatePowerLevels, "", &pl)
+	b.logAction(Action{
+		Kind:    "unmute",
+		Actor:   ev.Sender,
+		Target:  targetID.String(),
+		RoomID:  ev.RoomID,
+		Trigger: TriggerCommand,
+		Err:     err,
+	})
+	if err != nil {
+		return Failed("could not unmute user", err)
 	}
-	msg := strings.Join([]string{body[0], "was unmuted by", ev.Sender.String(), "in", ev.RoomID.String()}, " ")
-	sendNotice(ev.RoomID, msg)
+	msg := strings.Join([]string{targetID.String(), "was unmuted by", ev.Sender.String(), "in", ev.RoomID.String()}, " ")
+	b.sendNotice(ev.RoomID, msg)
+	return nil
 }
 
 // PinMessage pins the replied-to event.
-func PinMessage(body []string, ev event.Event) {
-	if !hasPerms(ev.RoomID, event.StatePinnedEvents) {
-		sendNotice(ev.RoomID, permsMessage)
-		return
+func (b *Bot) PinMessage(_ Args, ev event.Event) error {
+	if !b.hasPerms(ev.RoomID, event.StatePinnedEvents) {
+		return errNoPerms
 	}
 
 	relatesTo := ev.Content.AsMessage().RelatesTo
 	if relatesTo == nil {
-		sendNotice(ev.RoomID, "Reply to the message you want to pin!")
-		return
+		return BadArgs("Reply to the message you want to pin!")
 	}
 
 	p := event.PinnedEventsEventContent{}
 	// Avoid handling this error. The pinned event may not exist.
-	Client.StateEvent(ev.RoomID, event.StatePinnedEvents, "", &p)
+	b.Client.StateEvent(ev.RoomID, event.StatePinnedEvents, "", &p)
 
 	p.Pinned = append(p.Pinned, relatesTo.EventID)
-	Client.SendStateEvent(ev.RoomID, event.StatePinnedEvents, "", &p)
+	if _, err := b.Client.SendStateEvent(ev.RoomID, event.StatePinnedEvents, "", &p); err != nil {
+		return Failed("could not pin message", err)
+	}
+	return nil
 }
 
 // SayMessage sends a message into the chat.
-func SayMessage(body []string, ev event.Event) {
-	msg := strings.Join(body, " ")
-	sendNotice(ev.RoomID, msg)
+func (b *Bot) SayMessage(args Args, ev event.Event) error {
+	if args.Reason == "" {
+		return BadArgs("nothing to say!")
+	}
+	b.sendNotice(ev.RoomID, args.Reason)
+	return nil
 }
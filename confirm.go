@@ -0,0 +1,135 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// confirmTimeout is how long an action waits for confirmation.
+	confirmTimeout = 2 * time.Minute
+	// confirmSample is the amount of matched users shown in a preview.
+	confirmSample = 10
+	// confirmReaction is the reaction confirming an action.
+	confirmReaction = "✅"
+)
+
+// confirmation is an action awaiting confirmation by the admin who invoked
+// it, either by reacting to the preview or running the confirm command.
+type confirmation struct {
+	// the keyword of the invoking command, used when reporting errors
+	keyword string
+	// the invoking command
+	ev event.Event
+	// the preview sent in reply to the command
+	preview id.EventID
+
+	run   func() error
+	timer *time.Timer
+}
+
+// confirmKey identifies the pending confirmation of an admin in a room. Each
+// admin has at most one pending confirmation per room.
+type confirmKey struct {
+	roomID id.RoomID
+	sender id.UserID
+}
+
+// requestConfirmation replies to the command with a preview of the users the
+// action would affect, running it only once the invoker confirms. A previous
+// pending confirmation of the invoker in the room is replaced.
+func (b *Bot) requestConfirmation(keyword string, ev event.Event, users []id.UserID, run func() error) error {
+	names := make([]string, 0, confirmSample)
+	for i := 0; i < len(users) && i < confirmSample; i++ {
+		names = append(names, users[i].String())
+	}
+	msg := keyword + " would affect " + strconv.Itoa(len(users)) + " users: " + strings.Join(names, ", ")
+	if n := len(users) - len(names); n > 0 {
+		msg += " and " + strconv.Itoa(n) + " more"
+	}
+	msg += ". React with " + confirmReaction + " or run `" + b.commandPrefix(ev.RoomID) +
+		" confirm` within " + confirmTimeout.String() + " to proceed."
+
+	resp, err := b.sendReply(ev, msg)
+	if err != nil {
+		return Failed("could not send confirmation into room", err)
+	}
+
+	k := confirmKey{ev.RoomID, ev.Sender}
+	c := &confirmation{keyword: keyword, ev: ev, preview: resp.EventID, run: run}
+	c.timer = time.AfterFunc(confirmTimeout, func() {
+		if b.takeConfirmation(k, c.preview) != nil {
+			b.sendNotice(ev.RoomID, keyword, "by", ev.Sender.String(), "was not confirmed in time, cancelling.")
+		}
+	})
+
+	b.confirmLock.Lock()
+	defer b.confirmLock.Unlock()
+	if old, ok := b.confirmations[k]; ok {
+		old.timer.Stop()
+	}
+	b.confirmations[k] = c
+	return nil
+}
+
+// takeConfirmation removes and returns the pending confirmation of the key.
+// If preview is not empty, the confirmation must belong to that preview.
+func (b *Bot) takeConfirmation(k confirmKey, preview id.EventID) *confirmation {
+	b.confirmLock.Lock()
+	defer b.confirmLock.Unlock()
+
+	c, ok := b.confirmations[k]
+	if !ok || (preview != "" && c.preview != preview) {
+		return nil
+	}
+	c.timer.Stop()
+	delete(b.confirmations, k)
+	return c
+}
+
+// confirm runs a confirmed action, reporting the error it returns.
+func (b *Bot) confirm(c *confirmation) {
+	if err := c.run(); err != nil {
+		b.reportError(c.keyword, c.ev, err)
+	}
+}
+
+// ConfirmAction runs the pending action of the invoker in the room.
+func (b *Bot) ConfirmAction(_ Args, ev event.Event) error {
+	c := b.takeConfirmation(confirmKey{ev.RoomID, ev.Sender}, "")
+	if c == nil {
+		return NotFound("you have no action awaiting confirmation in this room")
+	}
+	b.confirm(c)
+	return nil
+}
+
+// HandleReaction handles m.reaction events, confirming pending actions.
+func (b *Bot) HandleReaction(s mautrix.EventSource, ev *event.Event) {
+	if !joined(s) {
+		return
+	}
+	r := ev.Content.AsReaction()
+	if r.RelatesTo.Type != event.RelAnnotation {
+		return
+	}
+	// some clients append the emoji variation selector
+	if strings.TrimSuffix(r.RelatesTo.Key, "\ufe0f") != confirmReaction {
+		return
+	}
+
+	if c := b.takeConfirmation(confirmKey{ev.RoomID, ev.Sender}, r.RelatesTo.EventID); c != nil {
+		if !b.queueCommand(ev.RoomID, func() { b.confirm(c) }) {
+			b.reportError(c.keyword, c.ev, errBusy)
+		}
+	}
+}
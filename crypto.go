@@ -0,0 +1,245 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build olm
+
+package fallacy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// cryptoState is the encryption state of a bot.
+type cryptoState struct {
+	// handles the encryption of rooms, nil if it is disabled
+	machine *crypto.OlmMachine
+	// tracks the encrypted rooms and their members
+	store *cryptoStateStore
+	// persists the keys of the machine
+	gob *crypto.GobStore
+}
+
+// cryptoLogger is the crypto.Logger writing to the logger of a bot.
+type cryptoLogger struct {
+	l *slog.Logger
+}
+
+func (c cryptoLogger) Error(msg string, args ...interface{}) {
+	c.l.Error(fmt.Sprintf(msg, args...))
+}
+
+func (c cryptoLogger) Warn(msg string, args ...interface{}) {
+	c.l.Warn(fmt.Sprintf(msg, args...))
+}
+
+func (c cryptoLogger) Debug(msg string, args ...interface{}) {
+	c.l.Debug(fmt.Sprintf(msg, args...))
+}
+
+// Trace is discarded as it is too verbose even for debugging fallacy.
+func (cryptoLogger) Trace(string, ...interface{}) {}
+
+// cryptoStateStore is the crypto.StateStore tracking the encryption and the
+// members of rooms, fetching them on first use.
+type cryptoStateStore struct {
+	bot *Bot
+
+	mu         sync.Mutex
+	encryption map[id.RoomID]*event.EncryptionEventContent
+	members    map[id.RoomID]map[id.UserID]bool
+}
+
+func (s *cryptoStateStore) IsEncrypted(roomID id.RoomID) bool {
+	return s.GetEncryptionEvent(roomID) != nil
+}
+
+func (s *cryptoStateStore) GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.encryption[roomID]; ok {
+		return e
+	}
+
+	var e *event.EncryptionEventContent
+	var he mautrix.HTTPError
+	if err := s.bot.Client.StateEvent(roomID, event.StateEncryption, "", &e); err != nil {
+		if !errors.As(err, &he) || he.RespError == nil || he.RespError.ErrCode != "M_NOT_FOUND" {
+			s.bot.roomLogger(roomID).Error("fetching room encryption failed", "error", err)
+			return nil
+		}
+		e = nil
+	}
+	s.encryption[roomID] = e
+	return e
+}
+
+func (s *cryptoStateStore) FindSharedRooms(userID id.UserID) (rooms []id.RoomID) {
+	s.mu.Lock()
+	var encrypted []id.RoomID
+	for roomID, e := range s.encryption {
+		if e != nil {
+			encrypted = append(encrypted, roomID)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, roomID := range encrypted {
+		if s.roomMembers(roomID)[userID] {
+			rooms = append(rooms, roomID)
+		}
+	}
+	return
+}
+
+// roomMembers returns the joined members of the room.
+func (s *cryptoStateStore) roomMembers(roomID id.RoomID) map[id.UserID]bool {
+	s.mu.Lock()
+	m, ok := s.members[roomID]
+	s.mu.Unlock()
+	if ok {
+		return m
+	}
+
+	jm, err := s.bot.Client.JoinedMembers(roomID)
+	if err != nil {
+		s.bot.roomLogger(roomID).Error("fetching room members failed", "error", err)
+		return nil
+	}
+	m = make(map[id.UserID]bool, len(jm.Joined))
+	for u := range jm.Joined {
+		m[u] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.members[roomID] = m
+	return m
+}
+
+// update updates the store with a state event.
+func (s *cryptoStateStore) update(ev *event.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch ev.Type {
+	case event.StateEncryption:
+		s.encryption[ev.RoomID] = ev.Content.AsEncryption()
+	case event.StateMember:
+		m, ok := s.members[ev.RoomID]
+		if !ok {
+			return
+		}
+		switch ev.Content.AsMember().Membership {
+		case event.MembershipJoin:
+			m[id.UserID(ev.GetStateKey())] = true
+		default:
+			delete(m, id.UserID(ev.GetStateKey()))
+		}
+	}
+}
+
+// setupCrypto loads the Olm machine with its state persisted at the path.
+// It must be called after logging in.
+func (b *Bot) setupCrypto(path string) error {
+	cs, err := crypto.NewGobStore(path)
+	if err != nil {
+		return err
+	}
+
+	ss := &cryptoStateStore{
+		bot:        b,
+		encryption: make(map[id.RoomID]*event.EncryptionEventContent),
+		members:    make(map[id.RoomID]map[id.UserID]bool),
+	}
+	mach := crypto.NewOlmMachine(b.Client, cryptoLogger{b.logger.With("component", "crypto")}, cs, ss)
+	if err := mach.Load(); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.crypto = cryptoState{machine: mach, store: ss, gob: cs}
+	return nil
+}
+
+// encryption returns the encryption state, which setupCrypto may replace while
+// events are already being handled.
+func (b *Bot) encryption() cryptoState {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.crypto
+}
+
+// flushCrypto saves the encryption keys to disk.
+func (b *Bot) flushCrypto() error {
+	gob := b.encryption().gob
+	if gob == nil {
+		return nil
+	}
+	return gob.Flush()
+}
+
+// cryptoSync is a sync handler passing the device lists, to-device events and
+// one-time key counts to the Olm machine.
+func (b *Bot) cryptoSync(res *mautrix.RespSync, since string) bool {
+	c := b.encryption()
+	if c.machine == nil {
+		return true
+	}
+	return c.machine.ProcessSyncResponse(res, since)
+}
+
+// cryptoEvent tracks the encryption state of the room of an event and returns
+// it decrypted if it is encrypted.
+func (b *Bot) cryptoEvent(ev *event.Event) (*event.Event, error) {
+	c := b.encryption()
+	if c.machine == nil {
+		return ev, nil
+	}
+
+	switch ev.Type {
+	case event.StateEncryption:
+		c.store.update(ev)
+	case event.StateMember:
+		c.store.update(ev)
+		c.machine.HandleMemberEvent(ev)
+	case event.EventEncrypted:
+		return c.machine.DecryptMegolmEvent(ev)
+	}
+	return ev, nil
+}
+
+// encryptContent encrypts the content of an event sent into an encrypted room,
+// sharing a group session with the members if there is none.
+func (b *Bot) encryptContent(roomID id.RoomID, t event.Type, content interface{}) (event.Type, interface{}, error) {
+	c := b.encryption()
+	if c.machine == nil || !c.store.IsEncrypted(roomID) {
+		return t, content, nil
+	}
+
+	enc, err := c.machine.EncryptMegolmEvent(roomID, t, content)
+	if crypto.IsShareError(err) {
+		var users []id.UserID
+		for u := range c.store.roomMembers(roomID) {
+			users = append(users, u)
+		}
+		if err = c.machine.ShareGroupSession(roomID, users); err != nil {
+			return t, nil, err
+		}
+		enc, err = c.machine.EncryptMegolmEvent(roomID, t, content)
+	}
+	if err != nil {
+		return t, nil, err
+	}
+	return event.EventEncrypted, enc, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The functions in this file act on the default bot, which is configured by
+// Config.New. Programs running multiple bots should use NewBot instead.
+
+// defaultBot is the bot the package level functions act on.
+var defaultBot = newBot()
+
+// Client is the client of the default bot, set by Config.New.
+var Client *mautrix.Client
+
+// New configures the default bot. Only the first configuration is applied.
+func (c Config) New() error {
+	if err := defaultBot.configure(c); err != nil {
+		return err
+	}
+	Client = defaultBot.Client
+	return nil
+}
+
+// Login logs the default bot in.
+func (c Config) Login() error {
+	return defaultBot.Login()
+}
+
+// Register registers a command with a keyword on the default bot.
+func Register(keyword string, callback Callback) {
+	defaultBot.Register(keyword, callback)
+}
+
+// RegisterAlias registers an alias for a command keyword on the default bot.
+func RegisterAlias(alias, keyword string) {
+	defaultBot.RegisterAlias(alias, keyword)
+}
+
+// NewSyncer returns a syncer of the default bot.
+func NewSyncer() *Syncer {
+	return defaultBot.NewSyncer()
+}
+
+// Run runs the default bot, see Bot.Run.
+func Run(s *Syncer) error {
+	return defaultBot.Run(s)
+}
+
+// Usage returns the usage guide of the commands of the default bot.
+func Usage() string {
+	return defaultBot.Usage()
+}
+
+func HandleUserPolicy(s mautrix.EventSource, ev *event.Event) {
+	defaultBot.HandleUserPolicy(s, ev)
+}
+
+func HandleServerPolicy(s mautrix.EventSource, ev *event.Event) {
+	defaultBot.HandleServerPolicy(s, ev)
+}
+
+func HandleMember(s mautrix.EventSource, ev *event.Event) {
+	defaultBot.HandleMember(s, ev)
+}
+
+func HandleMessage(s mautrix.EventSource, ev *event.Event) {
+	defaultBot.HandleMessage(s, ev)
+}
+
+func HandleTombstone(s mautrix.EventSource, ev *event.Event) {
+	defaultBot.HandleTombstone(s, ev)
+}
+
+func HandleReaction(s mautrix.EventSource, ev *event.Event) {
+	defaultBot.HandleReaction(s, ev)
+}
+
+func BanServer(roomID id.RoomID, homeserver string) error {
+	return defaultBot.BanServer(roomID, homeserver)
+}
+
+func RedactMessage(ev event.Event) error {
+	return defaultBot.RedactMessage(ev)
+}
+
+func WelcomeMember(display string, sender id.UserID, roomID id.RoomID) error {
+	return defaultBot.WelcomeMember(display, sender, roomID)
+}
+
+func BanUser(args Args, ev event.Event) error {
+	return defaultBot.BanUser(args, ev)
+}
+
+func KickUser(args Args, ev event.Event) error {
+	return defaultBot.KickUser(args, ev)
+}
+
+func CleanupUser(args Args, ev event.Event) error {
+	return defaultBot.CleanupUser(args, ev)
+}
+
+func ConfirmAction(args Args, ev event.Event) error {
+	return defaultBot.ConfirmAction(args, ev)
+}
+
+func ShowHistory(args Args, ev event.Event) error {
+	return defaultBot.ShowHistory(args, ev)
+}
+
+func WarnUser(args Args, ev event.Event) error {
+	return defaultBot.WarnUser(args, ev)
+}
+
+func ImportList(args Args, ev event.Event) error {
+	return defaultBot.ImportList(args, ev)
+}
+
+func MuteUser(args Args, ev event.Event) error {
+	return defaultBot.MuteUser(args, ev)
+}
+
+func UnmuteUser(args Args, ev event.Event) error {
+	return defaultBot.UnmuteUser(args, ev)
+}
+
+func PinMessage(args Args, ev event.Event) error {
+	return defaultBot.PinMessage(args, ev)
+}
+
+func SayMessage(args Args, ev event.Event) error {
+	return defaultBot.SayMessage(args, ev)
+}
+
+func CommandPurge(args Args, ev event.Event) error {
+	return defaultBot.CommandPurge(args, ev)
+}
+
+func PurgeUser(args Args, ev event.Event) error {
+	return defaultBot.PurgeUser(args, ev)
+}
+
+func PurgeMessages(args Args, ev event.Event) error {
+	return defaultBot.PurgeMessages(args, ev)
+}
+
+func ShowStatus(args Args, ev event.Event) error {
+	return defaultBot.ShowStatus(args, ev)
+}
+
+func Help(args Args, ev event.Event) error {
+	return defaultBot.Help(args, ev)
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"hash/fnv"
+	"runtime/debug"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	defaultWorkers    = 8
+	defaultQueueDepth = 256
+	defaultCommands   = 8
+)
+
+// Dispatch configures how events are passed to their listeners. The events of
+// a room are handled one at a time in the order they were received, while
+// rooms are handled in parallel by a pool of workers. Commands run off the
+// workers, one at a time per room.
+type Dispatch struct {
+	// the amount of workers handling events, defaults to 8
+	Workers int
+	// the amount of events waiting for each worker, beyond which events are
+	// dropped, defaults to 256
+	QueueDepth int `toml:"queue_depth"`
+	// the amount of rooms running commands at once, defaults to 8
+	Commands int
+}
+
+// limits returns the dispatch configuration with defaults applied.
+func (d Dispatch) limits() (workers, depth, commands int) {
+	workers, depth, commands = d.Workers, d.QueueDepth, d.Commands
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if depth <= 0 {
+		depth = defaultQueueDepth
+	}
+	if commands <= 0 {
+		commands = defaultCommands
+	}
+	return
+}
+
+// job is an event waiting for its listeners to be called.
+type job struct {
+	source    mautrix.EventSource
+	evt       *event.Event
+	listeners []mautrix.EventHandler
+	// the sync response of the event, if it was synced
+	batch *batch
+}
+
+// dispatcher is the pool of workers calling the listeners of events. Every
+// room is assigned to a single worker, which keeps its events in order.
+//
+// Commands may take long, so they are queued per room instead and run by a
+// separate pool, keeping the other rooms of the worker responsive.
+type dispatcher struct {
+	once   sync.Once
+	queues []chan job
+
+	// mutex protecting commands
+	mu sync.Mutex
+	// the commands waiting in each room running commands
+	commands map[id.RoomID][]func()
+	// the depth of the command queue of a room
+	depth int
+	// slots bounds the amount of rooms running commands
+	slots chan struct{}
+}
+
+// startWorkers starts the workers of the dispatcher.
+func (b *Bot) startWorkers() {
+	b.lock.RLock()
+	workers, depth, commands := b.config.Dispatch.limits()
+	b.lock.RUnlock()
+
+	b.dispatcher.commands = make(map[id.RoomID][]func())
+	b.dispatcher.depth = depth
+	b.dispatcher.slots = make(chan struct{}, commands)
+	b.dispatcher.queues = make([]chan job, workers)
+	for i := range b.dispatcher.queues {
+		q := make(chan job, depth)
+		b.dispatcher.queues[i] = q
+		go b.runWorker(q)
+	}
+}
+
+// runWorker calls the listeners of the jobs in the queue in order.
+func (b *Bot) runWorker(q chan job) {
+	for j := range q {
+		dispatchQueued.Dec()
+		for _, fn := range j.listeners {
+			fn(j.source, j.evt)
+		}
+		j.batch.release()
+		b.shutdown.work.Done()
+	}
+}
+
+// queueOf returns the queue of the worker handling a room.
+func (b *Bot) queueOf(roomID id.RoomID) chan job {
+	h := fnv.New32a()
+	h.Write([]byte(roomID))
+	return b.dispatcher.queues[h.Sum32()%uint32(len(b.dispatcher.queues))]
+}
+
+// dispatch queues an event of the sync response bt for its listeners, dropping
+// it if the queue of its room is full. A shutdown waits for the queued events.
+func (b *Bot) dispatch(source mautrix.EventSource, evt *event.Event, listeners []mautrix.EventHandler, bt *batch) {
+	b.dispatcher.once.Do(b.startWorkers)
+
+	q := b.queueOf(evt.RoomID)
+	b.shutdown.work.Add(1)
+	dispatchQueued.Inc()
+	bt.add()
+	select {
+	case q <- job{source, evt, listeners, bt}:
+	default:
+		dispatchQueued.Dec()
+		bt.release()
+		b.shutdown.work.Done()
+		eventsDropped.WithLabelValues(typeLabel(evt.Type)).Inc()
+		b.eventLogger(evt).Warn("dropping event, dispatch queue is full", "type", evt.Type.Type, "queue_depth", cap(q))
+	}
+}
+
+// queueCommand queues a command to run after the commands queued before it in
+// the room, returning false if the command queue of the room is full. A
+// shutdown waits for the queued commands.
+func (b *Bot) queueCommand(roomID id.RoomID, f func()) bool {
+	b.dispatcher.once.Do(b.startWorkers)
+
+	d := &b.dispatcher
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	queued, running := d.commands[roomID]
+	if len(queued) >= d.depth {
+		return false
+	}
+	b.shutdown.work.Add(1)
+	d.commands[roomID] = append(queued, f)
+	if !running {
+		go b.runCommands(roomID)
+	}
+	return true
+}
+
+// runCommands runs the queued commands of a room in order until none are
+// left, once a slot of the command pool is free.
+func (b *Bot) runCommands(roomID id.RoomID) {
+	d := &b.dispatcher
+	d.slots <- struct{}{}
+	defer func() { <-d.slots }()
+
+	for {
+		d.mu.Lock()
+		queued := d.commands[roomID]
+		if len(queued) == 0 {
+			delete(d.commands, roomID)
+			d.mu.Unlock()
+			return
+		}
+		f := queued[0]
+		d.commands[roomID] = queued[1:]
+		d.mu.Unlock()
+
+		b.runQueued(f)
+	}
+}
+
+// runQueued runs a queued command, logging a panic instead of crashing
+// fallacy.
+func (b *Bot) runQueued(f func()) {
+	defer b.shutdown.work.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			panicsRecovered.WithLabelValues("command").Inc()
+			b.logger.Error("command panicked", "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	f()
+}
@@ -0,0 +1,1155 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qua3k/fallacy"
+	"github.com/qua3k/fallacy/internal/fakehs"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// timeout is how long tests wait for the bot to act.
+const timeout = 5 * time.Second
+
+// env is a bot moderating a room on a fake homeserver.
+type env struct {
+	hs  *fakehs.Server
+	bot *fallacy.Bot
+
+	room                 id.RoomID
+	botID, admin, member id.UserID
+}
+
+// setup starts a fake homeserver with a room administered by admin, in which
+// the bot and member are joined, and logs the bot in. The options modify the
+// configuration of the bot.
+func setup(t *testing.T, options ...func(*env, *fallacy.Config)) *env {
+	t.Helper()
+
+	hs := fakehs.New("fake.test")
+	t.Cleanup(hs.Close)
+
+	e := &env{
+		hs:     hs,
+		botID:  hs.Register("fallacy", "hunter2"),
+		admin:  hs.Register("admin", "admin"),
+		member: hs.Register("member", "member"),
+	}
+	e.room = hs.CreateRoom(e.admin, e.botID, e.member)
+	hs.SetPowerLevel(e.room, e.botID, 100)
+
+	c := fallacy.Config{
+		Homeserver: hs.URL,
+		Username:   e.botID,
+		Password:   "hunter2",
+	}
+	for _, o := range options {
+		o(e, &c)
+	}
+	b, err := fallacy.NewBot(c)
+	if err != nil {
+		t.Fatal("creating bot failed:", err)
+	}
+	if err := b.Login(); err != nil {
+		t.Fatal("logging in failed:", err)
+	}
+	e.bot = b
+	return e
+}
+
+// send sends a message into the room and passes it to the bot.
+func (e *env) send(t *testing.T, sender id.UserID, c *event.MessageEventContent) *event.Event {
+	t.Helper()
+
+	if c.MsgType == "" {
+		c.MsgType = event.MsgText
+	}
+	ev := e.hs.Send(e.room, sender, event.EventMessage, c)
+	if err := ev.Content.ParseRaw(ev.Type); err != nil {
+		t.Fatal("parsing message failed:", err)
+	}
+	e.bot.HandleMessage(mautrix.EventSourceJoin|mautrix.EventSourceTimeline, ev)
+	return ev
+}
+
+// command sends a command into the room.
+func (e *env) command(t *testing.T, sender id.UserID, body string) *event.Event {
+	t.Helper()
+	return e.send(t, sender, &event.MessageEventContent{Body: body})
+}
+
+// await fails the test if cond doesn't become true in time.
+func (e *env) await(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	if !e.hs.Await(timeout, cond) {
+		t.Fatal("timed out waiting for", what)
+	}
+}
+
+// replied returns whether the bot sent a message containing the text.
+func (e *env) replied(text string) bool {
+	return e.count(text) > 0
+}
+
+// count returns the amount of messages the bot sent containing the text.
+func (e *env) count(text string) (n int) {
+	for _, ev := range e.hs.Timeline(e.room) {
+		if ev.Sender != e.botID || ev.Type != event.EventMessage {
+			continue
+		}
+		if body, _ := ev.Content.Raw["body"].(string); strings.Contains(body, text) {
+			n++
+		}
+	}
+	return
+}
+
+// run runs the bot with the syncer until the test is done, returning once the
+// initial sync, events of which are skipped, has been processed.
+func (e *env) run(t *testing.T, s *fallacy.Syncer) {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() { done <- e.bot.Run(s) }()
+	t.Cleanup(func() {
+		e.bot.Shutdown(context.Background())
+		<-done
+	})
+	e.await(t, "the initial sync", func() bool {
+		return e.bot.Client.Store.LoadNextBatch(e.botID) != ""
+	})
+}
+
+func TestBan(t *testing.T) {
+	e := setup(t)
+
+	e.command(t, e.admin, "!fallacy ban "+e.member.String()+" spamming")
+	e.await(t, "the ban", func() bool {
+		return e.hs.Membership(e.room, e.member) == event.MembershipBan
+	})
+
+	ev := e.hs.State(e.room, event.StateMember, e.member.String())
+	if reason, _ := ev.Content.Raw["reason"].(string); reason != "spamming" {
+		t.Errorf("ban reason = %q, want %q", reason, "spamming")
+	}
+	if ev.Sender != e.botID {
+		t.Errorf("ban sender = %s, want %s", ev.Sender, e.botID)
+	}
+}
+
+func TestBanRequiresPermission(t *testing.T) {
+	e := setup(t)
+
+	e.command(t, e.member, "!fallacy ban "+e.admin.String())
+	e.await(t, "the refusal", func() bool { return e.replied("requires") })
+
+	if m := e.hs.Membership(e.room, e.admin); m != event.MembershipJoin {
+		t.Errorf("admin membership = %s, want join", m)
+	}
+}
+
+func TestBanGlobConfirm(t *testing.T) {
+	e := setup(t)
+
+	// enough bystanders for the matches to stay within the safeguards
+	for i := 0; i < 8; i++ {
+		e.hs.Join(e.room, e.hs.Register(fmt.Sprintf("user%d", i), ""))
+	}
+	spammers := []id.UserID{e.hs.Register("spam1", ""), e.hs.Register("spam2", "")}
+	for _, u := range spammers {
+		e.hs.Join(e.room, u)
+	}
+
+	e.command(t, e.admin, "!fallacy ban @spam*:fake.test")
+	e.await(t, "the preview", func() bool { return e.replied("confirm") })
+	for _, u := range spammers {
+		if m := e.hs.Membership(e.room, u); m != event.MembershipJoin {
+			t.Fatalf("%s was actioned upon before confirming: membership %s", u, m)
+		}
+	}
+
+	e.command(t, e.admin, "!fallacy confirm")
+	for _, u := range spammers {
+		u := u
+		e.await(t, "the ban of "+u.String(), func() bool {
+			return e.hs.Membership(e.room, u) == event.MembershipBan
+		})
+	}
+	if m := e.hs.Membership(e.room, e.member); m != event.MembershipJoin {
+		t.Errorf("non-matching member membership = %s, want join", m)
+	}
+}
+
+func TestBanGlobConfirmChanged(t *testing.T) {
+	e := setup(t)
+
+	for i := 0; i < 8; i++ {
+		e.hs.Join(e.room, e.hs.Register(fmt.Sprintf("user%d", i), ""))
+	}
+	spammer := e.hs.Register("spam1", "")
+	e.hs.Join(e.room, spammer)
+
+	e.command(t, e.admin, "!fallacy ban @spam*:fake.test")
+	e.await(t, "the preview", func() bool { return e.replied("confirm") })
+
+	// a member joining after the preview wasn't shown to the admin
+	late := e.hs.Register("spam2", "")
+	e.hs.Join(e.room, late)
+
+	e.command(t, e.admin, "!fallacy confirm")
+	e.await(t, "the refusal", func() bool { return e.replied("changed since the preview") })
+	for _, u := range []id.UserID{spammer, late} {
+		if m := e.hs.Membership(e.room, u); m != event.MembershipJoin {
+			t.Errorf("%s membership = %s, want join", u, m)
+		}
+	}
+}
+
+func TestPurgeUser(t *testing.T) {
+	e := setup(t)
+
+	var spam []id.EventID
+	for i := 0; i < 3; i++ {
+		ev := e.hs.Send(e.room, e.member, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    "buy now",
+		})
+		spam = append(spam, ev.ID)
+	}
+	keep := e.hs.Send(e.room, e.admin, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "please stop",
+	})
+
+	e.command(t, e.admin, "!fallacy purge "+e.member.String())
+	for _, eventID := range spam {
+		eventID := eventID
+		e.await(t, "the redaction of "+eventID.String(), func() bool {
+			return e.hs.Redacted(e.room, eventID)
+		})
+	}
+	if e.hs.Redacted(e.room, keep.ID) {
+		t.Error("message of another user was redacted")
+	}
+}
+
+// TestPurgeUserDone checks a purge only reports and records the redactions it
+// completed.
+func TestPurgeUserDone(t *testing.T) {
+	var logRoom id.RoomID
+	e := setup(t, func(e *env, c *fallacy.Config) {
+		logRoom = e.hs.CreateRoom(e.admin, e.botID)
+		c.LogRoom = logRoom
+	})
+
+	var spam []id.EventID
+	for i := 0; i < 3; i++ {
+		ev := e.hs.Send(e.room, e.member, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    "buy now",
+		})
+		spam = append(spam, ev.ID)
+	}
+	e.hs.Protect(spam[0])
+
+	e.command(t, e.admin, "!fallacy purge "+e.member.String())
+	e.await(t, "the purge", func() bool { return e.replied("Purging messages done!") })
+	for _, eventID := range spam[1:] {
+		if !e.hs.Redacted(e.room, eventID) {
+			t.Errorf("%s was not redacted once the purge was done", eventID)
+		}
+	}
+	e.await(t, "the purge to be logged", func() bool {
+		for _, ev := range e.hs.Timeline(logRoom) {
+			if body, _ := ev.Content.Raw["body"].(string); ev.Sender == e.botID && strings.Contains(body, "events redacted") {
+				if !strings.Contains(body, "2 events redacted") {
+					t.Errorf("purge logged as %q, want 2 events redacted", body)
+				}
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// TestPurgeUserEncrypted checks encrypted messages are purged without
+// decrypting them.
+func TestPurgeUserEncrypted(t *testing.T) {
+	e := setup(t)
+
+	spam := e.hs.Send(e.room, e.member, event.EventEncrypted, &event.EncryptedEventContent{
+		Algorithm:        id.AlgorithmMegolmV1,
+		MegolmCiphertext: []byte("ciphertext"),
+		SessionID:        "session",
+	})
+
+	e.command(t, e.admin, "!fallacy purge "+e.member.String())
+	e.await(t, "the redaction of the encrypted message", func() bool {
+		return e.hs.Redacted(e.room, spam.ID)
+	})
+}
+
+func TestPurgeUserCount(t *testing.T) {
+	e := setup(t)
+
+	spam := e.hs.Send(e.room, e.member, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "buy now",
+	})
+
+	for _, count := range []string{"0", "-5"} {
+		before := e.count("at least 1")
+		e.command(t, e.admin, "!fallacy purge "+e.member.String()+" "+count)
+		e.await(t, "the refusal of "+count, func() bool { return e.count("at least 1") > before })
+	}
+	if e.hs.Redacted(e.room, spam.ID) {
+		t.Error("message was redacted by a purge of less than 1 message")
+	}
+}
+
+func TestCleanupBanFailed(t *testing.T) {
+	e := setup(t)
+
+	// the member can't be banned in the second room, where it is as powerful
+	// as the invoker
+	other := e.hs.CreateRoom(e.admin, e.botID, e.member)
+	e.hs.SetPowerLevel(other, e.botID, 100)
+	e.hs.SetPowerLevel(other, e.member, 100)
+
+	var spam []*event.Event
+	for _, roomID := range []id.RoomID{e.room, other} {
+		spam = append(spam, e.hs.Send(roomID, e.member, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    "buy now",
+		}))
+	}
+
+	e.command(t, e.admin, "!fallacy cleanup --ban "+e.member.String()+" spam")
+	e.await(t, "the reply", func() bool { return e.replied("Cleaned up") })
+	if !e.replied("in 1 rooms!") || !e.replied("Failed in 1 rooms") || !e.replied(other.String()) {
+		t.Error("reply doesn't report the failed room")
+	}
+	if !e.replied("not below yours") {
+		t.Error("reply doesn't report why the room failed")
+	}
+	if m := e.hs.Membership(e.room, e.member); m != event.MembershipBan {
+		t.Errorf("member membership = %s, want ban", m)
+	}
+	e.await(t, "the redaction of "+spam[0].ID.String(), func() bool {
+		return e.hs.Redacted(e.room, spam[0].ID)
+	})
+	if m := e.hs.Membership(other, e.member); m != event.MembershipJoin {
+		t.Errorf("member membership in the other room = %s, want join", m)
+	}
+	if e.hs.Redacted(other, spam[1].ID) {
+		t.Error("message in the room the member outranks the invoker in was redacted")
+	}
+}
+
+func TestCleanupBanRequiresBanLevel(t *testing.T) {
+	e := setup(t)
+
+	// the moderator may only redact
+	mod := e.hs.Register("mod", "mod")
+	e.hs.Join(e.room, mod)
+	pl := e.hs.PowerLevels(e.room)
+	pl.SetUserLevel(mod, 10)
+	pl.RedactPtr = new(int)
+	*pl.RedactPtr = 10
+	e.hs.SetState(e.room, e.admin, event.StatePowerLevels, "", pl)
+
+	e.command(t, mod, "!fallacy cleanup --ban "+e.member.String())
+	e.await(t, "the reply", func() bool { return e.replied("Failed in 1 rooms") })
+	if !e.replied("requires the ban power level") {
+		t.Error("reply doesn't report the missing ban level")
+	}
+	if m := e.hs.Membership(e.room, e.member); m != event.MembershipJoin {
+		t.Errorf("member membership = %s, want join", m)
+	}
+}
+
+func TestPolicyCleanupAuthority(t *testing.T) {
+	e := setup(t, func(_ *env, c *fallacy.Config) { c.PolicyCleanup = true })
+
+	// the admin has no power in the other room
+	owner := e.hs.Register("owner", "owner")
+	other := e.hs.CreateRoom(owner, e.botID, e.member, e.admin)
+	e.hs.SetPowerLevel(other, e.botID, 100)
+
+	var spam []*event.Event
+	for _, roomID := range []id.RoomID{e.room, other} {
+		spam = append(spam, e.hs.Send(roomID, e.member, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    "buy now",
+		}))
+	}
+
+	ev := e.hs.SetState(e.room, e.admin, event.StatePolicyUser, "rule", map[string]string{
+		"entity":         e.member.String(),
+		"recommendation": "m.ban",
+		"reason":         "spam",
+	})
+	if err := ev.Content.ParseRaw(ev.Type); err != nil {
+		t.Fatal("parsing policy failed:", err)
+	}
+	e.bot.HandleUserPolicy(mautrix.EventSourceJoin|mautrix.EventSourceTimeline, ev)
+
+	e.await(t, "the redaction in the policy room", func() bool {
+		return e.hs.Redacted(e.room, spam[0].ID)
+	})
+	// shutting down waits for the cleanup
+	if err := e.bot.Shutdown(context.Background()); err != nil {
+		t.Fatal("shutting down failed:", err)
+	}
+	if e.hs.Redacted(other, spam[1].ID) {
+		t.Error("message in a room the policy sender doesn't administer was redacted")
+	}
+}
+
+func TestPurgeMessages(t *testing.T) {
+	e := setup(t)
+
+	keep := e.hs.Send(e.room, e.member, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "hello",
+	})
+	first := e.hs.Send(e.room, e.member, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "spam",
+	})
+	second := e.hs.Send(e.room, e.member, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "more spam",
+	})
+
+	cmd := e.send(t, e.admin, &event.MessageEventContent{
+		Body: "!fallacy purge",
+		RelatesTo: &event.RelatesTo{
+			Type:    event.RelReply,
+			EventID: first.ID,
+		},
+	})
+	for _, eventID := range []id.EventID{first.ID, second.ID, cmd.ID} {
+		eventID := eventID
+		e.await(t, "the redaction of "+eventID.String(), func() bool {
+			return e.hs.Redacted(e.room, eventID)
+		})
+	}
+	if e.hs.Redacted(e.room, keep.ID) {
+		t.Error("message before the purged one was redacted")
+	}
+}
+
+func TestMute(t *testing.T) {
+	e := setup(t)
+
+	muted := func() bool {
+		pl := e.hs.PowerLevels(e.room)
+		return pl.GetUserLevel(e.member) < pl.GetEventLevel(event.EventMessage)
+	}
+
+	e.command(t, e.admin, "!fallacy mute "+e.member.String())
+	e.await(t, "the mute", func() bool { return muted() && e.replied("was muted by") })
+
+	e.command(t, e.admin, "!fallacy umute "+e.member.String())
+	e.await(t, "the unmute", func() bool { return !muted() && e.replied("was unmuted by") })
+}
+
+func TestImport(t *testing.T) {
+	e := setup(t)
+
+	list := e.hs.CreateRoom(e.admin)
+	e.hs.SetAlias("#bans:fake.test", list)
+	e.hs.SetState(list, e.admin, event.StatePolicyUser, "rule1", map[string]string{
+		"entity":         e.member.String(),
+		"recommendation": "m.ban",
+		"reason":         "spam",
+	})
+
+	e.command(t, e.admin, "!fallacy import #bans:fake.test")
+	e.await(t, "the ban", func() bool {
+		return e.hs.Membership(e.room, e.member) == event.MembershipBan
+	})
+
+	if ev := e.hs.State(e.room, event.StatePolicyUser, "rule1"); ev == nil {
+		t.Error("policy was not copied into the room")
+	}
+	if m := e.hs.Membership(list, e.botID); m != event.MembershipJoin {
+		t.Errorf("bot membership in the list = %s, want join", m)
+	}
+}
+
+func TestSync(t *testing.T) {
+	e := setup(t)
+
+	s := e.bot.NewSyncer()
+	s.OnEventType(event.EventMessage, e.bot.HandleMessage)
+
+	e.run(t, s)
+
+	e.hs.Send(e.room, e.admin, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "!fallacy say hello there",
+	})
+	e.await(t, "the reply", func() bool { return e.replied("hello there") })
+}
+
+func TestRateLimited(t *testing.T) {
+	e := setup(t)
+
+	const backoff = 200 * time.Millisecond
+	e.hs.RateLimit(1, backoff)
+	start := time.Now()
+	e.command(t, e.admin, "!fallacy ban "+e.member.String())
+	e.await(t, "the ban", func() bool {
+		return e.hs.Membership(e.room, e.member) == event.MembershipBan
+	})
+	if d := time.Since(start); d < backoff {
+		t.Errorf("banned after %s, want a retry after the backoff of %s", d, backoff)
+	}
+}
+
+func TestLoginInvalidAccessToken(t *testing.T) {
+	e := setup(t, func(_ *env, c *fallacy.Config) {
+		c.AccessToken = "syt_invalid"
+	})
+
+	e.command(t, e.admin, "!fallacy ban "+e.member.String())
+	e.await(t, "the ban", func() bool {
+		return e.hs.Membership(e.room, e.member) == event.MembershipBan
+	})
+}
+
+func TestCommandInvalidatedSession(t *testing.T) {
+	e := setup(t)
+	e.hs.Invalidate(e.botID)
+
+	e.command(t, e.admin, "!fallacy ban "+e.member.String())
+	e.await(t, "the ban", func() bool {
+		return e.hs.Membership(e.room, e.member) == event.MembershipBan
+	})
+}
+
+func TestStatus(t *testing.T) {
+	e := setup(t)
+
+	e.command(t, e.admin, "!fallacy status")
+	e.await(t, "the status", func() bool { return e.replied("fallacy status") })
+	if !e.replied("All features are available.") {
+		t.Error("status reports disabled features of a room fallacy administers")
+	}
+	if e.replied("kick") {
+		t.Error("status reports the kick permission, which no feature needs")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	e := setup(t)
+
+	s := e.bot.NewSyncer()
+	s.OnEventType(event.EventMessage, e.bot.HandleMessage)
+
+	done := make(chan error, 1)
+	go func() { done <- e.bot.Run(s) }()
+	e.await(t, "the initial sync", func() bool {
+		return e.bot.Client.Store.LoadNextBatch(e.botID) != ""
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.bot.Shutdown(ctx); err != nil {
+		t.Fatal("shutting down failed:", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Run returned", err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for Run to return")
+	}
+
+	e.command(t, e.admin, "!fallacy ban "+e.member.String())
+	e.await(t, "the refusal", func() bool { return e.replied("shutting down") })
+	if m := e.hs.Membership(e.room, e.member); m != event.MembershipJoin {
+		t.Errorf("member membership = %s, want join", m)
+	}
+}
+
+func TestSyncSources(t *testing.T) {
+	e := setup(t)
+
+	type received struct {
+		source mautrix.EventSource
+		room   id.RoomID
+		t      event.Type
+	}
+	var (
+		mu   sync.Mutex
+		seen []received
+	)
+	s := e.bot.NewSyncer()
+	s.OnEvent(func(source mautrix.EventSource, ev *event.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, received{source, ev.RoomID, ev.Type})
+	})
+	saw := func(want received) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, r := range seen {
+				if r == want {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	e.run(t, s)
+
+	invited := e.hs.CreateRoom(e.admin)
+	e.hs.Invite(invited, e.admin, e.botID)
+	e.await(t, "the invite", saw(received{
+		mautrix.EventSourceInvite | mautrix.EventSourceState, invited, event.StateMember,
+	}))
+
+	e.hs.Kick(e.room, e.admin, e.botID)
+	e.await(t, "the kick", saw(received{
+		mautrix.EventSourceLeave | mautrix.EventSourceTimeline, e.room, event.StateMember,
+	}))
+}
+
+// messages sends n numbered messages into the room as the member.
+func (e *env) messages(n int) {
+	for i := 0; i < n; i++ {
+		e.hs.Send(e.room, e.member, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    strconv.Itoa(i),
+		})
+	}
+}
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening failed:", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestAppservice(t *testing.T) {
+	var reg *appservice.Registration
+	e := setup(t, func(e *env, c *fallacy.Config) {
+		c.HTTPListen = freeAddr(t)
+		c.PermittedRooms = []id.RoomID{e.room}
+		c.Appservice = fallacy.Appservice{
+			Registration: filepath.Join(t.TempDir(), "registration.yaml"),
+			URL:          "http://" + c.HTTPListen,
+		}
+		if err := c.GenerateRegistration(); err != nil {
+			t.Fatal("generating registration failed:", err)
+		}
+		var err error
+		if reg, err = appservice.LoadRegistration(c.Appservice.Registration); err != nil {
+			t.Fatal("loading registration failed:", err)
+		}
+		e.hs.AddAppservice(e.botID, reg.AppToken, c.Appservice.URL)
+	})
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[id.EventID]int)
+	)
+	s := e.bot.NewSyncer()
+	s.OnEventType(event.EventMessage, e.bot.HandleMessage)
+	s.OnEvent(func(_ mautrix.EventSource, ev *event.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[ev.ID]++
+	})
+	done := make(chan error, 1)
+	go func() { done <- e.bot.Run(s) }()
+	e.await(t, "the transaction handler", func() bool {
+		status, _ := e.hs.Push(reg.ServerToken, "0")
+		return status == http.StatusOK
+	})
+
+	other := e.hs.CreateRoom(e.admin, e.botID, e.member)
+	e.hs.SetPowerLevel(other, e.botID, 100)
+	command := &event.MessageEventContent{MsgType: event.MsgText, Body: "!fallacy ban " + e.member.String()}
+	forged := e.hs.Send(e.room, e.admin, event.EventMessage, command)
+	ban := e.hs.Send(e.room, e.admin, event.EventMessage, command)
+	unpermitted := e.hs.Send(other, e.admin, event.EventMessage, command)
+
+	if status, err := e.hs.Push("wrong", "1", forged); err != nil || status != http.StatusForbidden {
+		t.Errorf("pushing with a wrong hs_token = %d, %v, want %d", status, err, http.StatusForbidden)
+	}
+	for i := 0; i < 2; i++ {
+		if status, err := e.hs.Push(reg.ServerToken, "2", ban, unpermitted); err != nil || status != http.StatusOK {
+			t.Fatalf("pushing transaction = %d, %v, want %d", status, err, http.StatusOK)
+		}
+	}
+
+	e.await(t, "the ban", func() bool {
+		return e.hs.Membership(e.room, e.member) == event.MembershipBan
+	})
+
+	// shutting down waits for the queued events to be handled
+	if err := e.bot.Shutdown(context.Background()); err != nil {
+		t.Fatal("shutting down failed:", err)
+	}
+	if err := <-done; err != nil {
+		t.Error("Run returned", err)
+	}
+
+	for ev, want := range map[id.EventID]int{forged.ID: 0, ban.ID: 1, unpermitted.ID: 0} {
+		if n := seen[ev]; n != want {
+			t.Errorf("event %s handled %d times, want %d", ev, n, want)
+		}
+	}
+	if m := e.hs.Membership(other, e.member); m != event.MembershipJoin {
+		t.Errorf("member membership in the unpermitted room = %s, want join", m)
+	}
+}
+
+func TestDispatchOrder(t *testing.T) {
+	e := setup(t)
+
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+	s := e.bot.NewSyncer()
+	s.OnEventType(event.EventMessage, func(_ mautrix.EventSource, ev *event.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, ev.Content.AsMessage().Body)
+	})
+	e.run(t, s)
+
+	const n = 50
+	e.messages(n)
+	e.await(t, "the messages", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(bodies) == n
+	})
+	for i, body := range bodies {
+		if body != strconv.Itoa(i) {
+			t.Fatalf("message %d handled as %s", i, body)
+		}
+	}
+}
+
+// TestCommandOrder checks a command runs only once the commands sent before it
+// in the room are done, even if it is quicker.
+func TestCommandOrder(t *testing.T) {
+	e := setup(t)
+
+	s := e.bot.NewSyncer()
+	s.OnEventType(event.EventMessage, e.bot.HandleMessage)
+	e.run(t, s)
+
+	e.messages(5)
+	for _, body := range []string{"!fallacy purge " + e.member.String(), "!fallacy say said"} {
+		e.hs.Send(e.room, e.admin, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    body,
+		})
+	}
+	e.await(t, "the replies", func() bool { return e.replied("Purging messages done!") && e.replied("said") })
+
+	var replies []string
+	for _, ev := range e.hs.Timeline(e.room) {
+		if ev.Sender == e.botID && ev.Type == event.EventMessage {
+			body, _ := ev.Content.Raw["body"].(string)
+			replies = append(replies, body)
+		}
+	}
+	if want := []string{"Purging messages done!", "said"}; !slices.Equal(replies, want) {
+		t.Errorf("replies = %q, want %q", replies, want)
+	}
+}
+
+// TestCommandOffWorker checks a long command doesn't hold up the events of the
+// rooms sharing the worker of its room.
+func TestCommandOffWorker(t *testing.T) {
+	e := setup(t, func(_ *env, c *fallacy.Config) {
+		c.Dispatch = fallacy.Dispatch{Workers: 1}
+	})
+	other := e.hs.CreateRoom(e.admin, e.botID)
+	e.hs.SetPowerLevel(other, e.botID, 100)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	e.bot.Register("block", fallacy.Callback{
+		Function: func(fallacy.Args, event.Event) error {
+			close(started)
+			<-release
+			return nil
+		},
+	})
+
+	s := e.bot.NewSyncer()
+	s.OnEventType(event.EventMessage, e.bot.HandleMessage)
+	e.run(t, s)
+
+	e.hs.Send(e.room, e.admin, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "!fallacy block",
+	})
+	select {
+	case <-started:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the command to start")
+	}
+	e.hs.Send(other, e.admin, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "!fallacy say unblocked",
+	})
+	e.await(t, "the reply in the other room", func() bool {
+		for _, ev := range e.hs.Timeline(other) {
+			if body, _ := ev.Content.Raw["body"].(string); ev.Sender == e.botID && body == "unblocked" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestDispatchOverflow(t *testing.T) {
+	e := setup(t, func(_ *env, c *fallacy.Config) {
+		c.Dispatch = fallacy.Dispatch{Workers: 1, QueueDepth: 2}
+	})
+
+	var (
+		mu      sync.Mutex
+		handled int
+	)
+	release, marked, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	marker := event.Type{Type: "test.marker", Class: event.MessageEventType}
+	s := e.bot.NewSyncer()
+	s.OnSync(func(res *mautrix.RespSync, _ string) bool {
+		for _, room := range res.Rooms.Join {
+			for _, ev := range room.Timeline.Events {
+				if ev.Type.Type == marker.Type {
+					close(marked)
+				}
+			}
+		}
+		return true
+	})
+	s.OnEventType(event.EventMessage, func(_ mautrix.EventSource, ev *event.Event) {
+		<-release
+		if ev.Content.AsMessage().Body == "done" {
+			close(done)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+	})
+	e.run(t, s)
+
+	// two messages wait in the queue, and one more is handled if the worker
+	// took it off the queue before the others arrived. Once the messages have
+	// been synced the marker arrives in a later sync, which is only processed
+	// after the messages were dispatched.
+	e.messages(10)
+	e.await(t, "the messages to be synced", func() bool {
+		return e.bot.Client.Store.LoadNextBatch(e.botID) == e.hs.NextBatch()
+	})
+	e.hs.Send(e.room, e.member, marker, map[string]string{})
+	select {
+	case <-marked:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the marker")
+	}
+	close(release)
+
+	e.await(t, "the queued messages", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handled >= 2
+	})
+
+	// at most one message is left in the queue, so the last message fits and
+	// is handled after every message that wasn't dropped
+	e.hs.Send(e.room, e.member, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "done",
+	})
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the last message")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if handled > 3 {
+		t.Errorf("handled %d messages, want at most 3", handled)
+	}
+}
+
+func TestCommandPanic(t *testing.T) {
+	var logRoom id.RoomID
+	e := setup(t, func(e *env, c *fallacy.Config) {
+		logRoom = e.hs.CreateRoom(e.admin, e.botID)
+		c.LogRoom = logRoom
+	})
+	e.bot.Register("boom", fallacy.Callback{
+		Function:   func(fallacy.Args, event.Event) error { panic("boom") },
+		Permission: fallacy.PermAdmin,
+	})
+
+	logged := func(n int) func() bool {
+		return func() bool {
+			var panics int
+			for _, ev := range e.hs.Timeline(logRoom) {
+				if body, _ := ev.Content.Raw["body"].(string); strings.HasPrefix(body, "panic\n") {
+					panics++
+				}
+			}
+			return panics == n
+		}
+	}
+
+	// the command keeps running until the circuit breaker trips
+	for i := 1; i <= 3; i++ {
+		e.command(t, e.admin, "!fallacy boom")
+		e.await(t, fmt.Sprintf("panic %d to be logged", i), logged(i))
+	}
+	e.await(t, "the failure reply", func() bool { return e.replied("boom failed") })
+
+	e.command(t, e.admin, "!fallacy boom")
+	e.await(t, "the refusal", func() bool { return e.replied("boom is disabled") })
+
+	// other commands keep working
+	e.command(t, e.admin, "!fallacy say still alive")
+	e.await(t, "the reply", func() bool { return e.replied("still alive") })
+}
+
+func TestTombstoneMalformed(t *testing.T) {
+	var logRoom id.RoomID
+	e := setup(t, func(e *env, c *fallacy.Config) {
+		logRoom = e.hs.CreateRoom(e.admin, e.botID)
+		c.LogRoom = logRoom
+	})
+
+	// the events of a room are handled in order, so the tombstones were
+	// handled once the marker is
+	marked := make(chan struct{})
+	s := e.bot.NewSyncer()
+	s.OnEventType(event.StateTombstone, e.bot.HandleTombstone)
+	s.OnEventType(event.EventMessage, func(_ mautrix.EventSource, ev *event.Event) {
+		if ev.Content.AsMessage().Body == "marker" {
+			close(marked)
+		}
+	})
+	e.run(t, s)
+
+	before, err := e.bot.Client.JoinedRooms()
+	if err != nil {
+		t.Fatal("fetching joined rooms failed:", err)
+	}
+	e.hs.SetState(e.room, e.admin, event.StateTombstone, "", map[string]int{"replacement_room": 1})
+	e.hs.SetState(e.room, e.admin, event.StateTombstone, "", map[string]string{"body": "no replacement"})
+	e.hs.Send(e.room, e.admin, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "marker"})
+	select {
+	case <-marked:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the marker")
+	}
+
+	after, err := e.bot.Client.JoinedRooms()
+	if err != nil {
+		t.Fatal("fetching joined rooms failed:", err)
+	}
+	if len(after.JoinedRooms) != len(before.JoinedRooms) {
+		t.Errorf("joined rooms changed from %v to %v", before.JoinedRooms, after.JoinedRooms)
+	}
+	if e.replied("attempting to join room") {
+		t.Error("joining the replacement room was attempted")
+	}
+	for _, ev := range e.hs.Timeline(logRoom) {
+		if body, _ := ev.Content.Raw["body"].(string); strings.HasPrefix(body, "panic\n") {
+			t.Errorf("panic logged: %s", body)
+		}
+	}
+}
+
+// settingsType is the room account data event type of the room settings.
+const settingsType = "io.github.qua3k.fallacy.settings"
+
+func TestAccountDataSettings(t *testing.T) {
+	e := setup(t, func(e *env, c *fallacy.Config) {
+		c.AccountData = true
+		e.hs.SetAccountData(e.botID, e.room, settingsType, map[string]string{"prefix": "!mod"})
+	})
+
+	e.command(t, e.admin, "!mod say stored prefix")
+	e.await(t, "the reply", func() bool { return e.replied("stored prefix") })
+
+	updated := make(chan struct{}, 1)
+	s := e.bot.NewSyncer()
+	// listeners of a room run in order, so the bot has seen the change once
+	// this is called
+	s.OnEventType(event.Type{Type: settingsType, Class: event.AccountDataEventType}, func(mautrix.EventSource, *event.Event) {
+		updated <- struct{}{}
+	})
+	e.run(t, s)
+
+	e.hs.SetAccountData(e.botID, e.room, settingsType, map[string]string{"prefix": "!bot"})
+	select {
+	case <-updated:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the settings to sync")
+	}
+
+	e.command(t, e.admin, "!bot say synced prefix")
+	e.await(t, "the reply", func() bool { return e.replied("synced prefix") })
+}
+
+func TestAccountDataState(t *testing.T) {
+	e := setup(t, func(_ *env, c *fallacy.Config) { c.AccountData = true })
+
+	s := e.bot.NewSyncer()
+	done := make(chan error, 1)
+	go func() { done <- e.bot.Run(s) }()
+	e.await(t, "the initial sync", func() bool {
+		return e.bot.Client.Store.LoadNextBatch(e.botID) != ""
+	})
+
+	e.command(t, e.admin, "!fallacy ban "+e.member.String()+" spamming")
+	e.await(t, "the ban", func() bool {
+		return e.hs.Membership(e.room, e.member) == event.MembershipBan
+	})
+	e.command(t, e.admin, "!fallacy history "+e.member.String())
+	e.await(t, "the history", func() bool { return e.replied("Moderation history") })
+
+	// the history and sync token are only written once shutting down flushes
+	// them
+	history := func() string {
+		return string(e.hs.AccountData(e.botID, "", "io.github.qua3k.fallacy.history"))
+	}
+	if strings.Contains(history(), e.member.String()) {
+		t.Error("history record was written before the flush")
+	}
+	if err := e.bot.Shutdown(context.Background()); err != nil {
+		t.Fatal("shutting down failed:", err)
+	}
+	<-done
+	if !strings.Contains(history(), e.member.String()) {
+		t.Errorf("history account data = %s, want the ban", history())
+	}
+	state := string(e.hs.AccountData(e.botID, "", "io.github.qua3k.fallacy.state"))
+	if !strings.Contains(state, "next_batch/"+e.botID.String()) {
+		t.Errorf("state account data = %s, want the sync token", state)
+	}
+}
+
+// TestAccountDataQuietSync checks a sync woken up only by fallacy writing its
+// own account data doesn't change the saved sync token, which would make the
+// state be written again after every write.
+func TestAccountDataQuietSync(t *testing.T) {
+	e := setup(t, func(_ *env, c *fallacy.Config) { c.AccountData = true })
+
+	s := e.bot.NewSyncer()
+	done := make(chan error, 1)
+	go func() { done <- e.bot.Run(s) }()
+	e.await(t, "the initial sync", func() bool {
+		return e.bot.Client.Store.LoadNextBatch(e.botID) != ""
+	})
+	synced := e.bot.Client.Store.LoadNextBatch(e.botID)
+
+	e.hs.SetAccountData(e.botID, "", "io.github.qua3k.fallacy.history", map[string][]string{"records": {}})
+	e.await(t, "the quiet sync", func() bool {
+		return e.bot.Client.Store.LoadNextBatch(e.botID) == e.hs.NextBatch()
+	})
+
+	if err := e.bot.Shutdown(context.Background()); err != nil {
+		t.Fatal("shutting down failed:", err)
+	}
+	<-done
+	var state struct {
+		Values map[string]string `json:"values"`
+	}
+	if err := json.Unmarshal(e.hs.AccountData(e.botID, "", "io.github.qua3k.fallacy.state"), &state); err != nil {
+		t.Fatal("parsing state account data failed:", err)
+	}
+	if got := state.Values["next_batch/"+e.botID.String()]; got != synced {
+		t.Errorf("saved sync token = %q, want %q", got, synced)
+	}
+}
+
+func TestAuditGlob(t *testing.T) {
+	var logRoom id.RoomID
+	e := setup(t, func(e *env, c *fallacy.Config) {
+		logRoom = e.hs.CreateRoom(e.admin, e.botID)
+		c.LogRoom = logRoom
+	})
+	entries := func(text string) (n int) {
+		for _, ev := range e.hs.Timeline(logRoom) {
+			if body, _ := ev.Content.Raw["body"].(string); ev.Sender == e.botID && strings.Contains(body, text) {
+				n++
+			}
+		}
+		return
+	}
+
+	for i := 0; i < 8; i++ {
+		e.hs.Join(e.room, e.hs.Register(fmt.Sprintf("user%d", i), ""))
+	}
+	spammers := []id.UserID{e.hs.Register("spam1", ""), e.hs.Register("spam2", "")}
+	for _, u := range spammers {
+		e.hs.Join(e.room, u)
+	}
+
+	// refused actions are logged too
+	e.command(t, e.admin, "!fallacy ban --force --yes @spam*:fake.test")
+	e.await(t, "the refusal to be logged", func() bool { return entries("only fallacy admins") == 1 })
+
+	e.command(t, e.admin, "!fallacy ban --yes @spam*:fake.test spam")
+	e.await(t, "the glob ban to be logged", func() bool { return entries("2 of 2 matching users") == 1 })
+	for _, u := range spammers {
+		if m := e.hs.Membership(e.room, u); m != event.MembershipBan {
+			t.Errorf("%s membership = %s, want ban", u, m)
+		}
+		if n := entries(u.String()); n != 0 {
+			t.Errorf("%s was logged %d times, want only the glob", u, n)
+		}
+	}
+}
+
+func TestHistoryVolatile(t *testing.T) {
+	e := setup(t)
+
+	e.command(t, e.admin, "!fallacy history "+e.member.String())
+	e.await(t, "the reply", func() bool { return e.replied("No moderation history") })
+	if !e.replied("not persisted") {
+		t.Error("reply doesn't note that the history is kept in memory")
+	}
+}
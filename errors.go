@@ -0,0 +1,149 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"errors"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+// ErrorKind classifies the errors returned by commands.
+type ErrorKind int
+
+const (
+	// KindInternal errors are failures of fallacy or the homeserver.
+	KindInternal ErrorKind = iota
+	// KindPermission errors are missing permissions of the invoker or fallacy.
+	KindPermission
+	// KindArgs errors are invalid arguments passed to a command.
+	KindArgs
+	// KindNotFound errors are references to things that don't exist.
+	KindNotFound
+	// KindRefused errors are actions fallacy refuses to take.
+	KindRefused
+)
+
+// String returns the name of the kind.
+func (k ErrorKind) String() string {
+	switch k {
+	case KindPermission:
+		return "permission"
+	case KindArgs:
+		return "args"
+	case KindNotFound:
+		return "not_found"
+	case KindRefused:
+		return "refused"
+	}
+	return "internal"
+}
+
+// kindOf returns the kind of an error, or KindInternal if it is not a
+// CommandError.
+func kindOf(err error) ErrorKind {
+	var ce *CommandError
+	if errors.As(err, &ce) {
+		return ce.Kind
+	}
+	return KindInternal
+}
+
+// CommandError is an error returned by a command. The message is shown to the
+// invoker while the wrapped error is only logged.
+type CommandError struct {
+	Kind    ErrorKind
+	Message string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Denied returns a permission denied error.
+func Denied(msg string) error {
+	return &CommandError{Kind: KindPermission, Message: msg}
+}
+
+// BadArgs returns an invalid arguments error.
+func BadArgs(msg string) error {
+	return &CommandError{Kind: KindArgs, Message: msg}
+}
+
+// NotFound returns a not found error.
+func NotFound(msg string) error {
+	return &CommandError{Kind: KindNotFound, Message: msg}
+}
+
+// Refused returns an error for an action fallacy refuses to take.
+func Refused(msg string) error {
+	return &CommandError{Kind: KindRefused, Message: msg}
+}
+
+// Failed wraps an error of a failed action. Errors of other kinds than
+// KindInternal are returned as is, keeping their message.
+func Failed(msg string, err error) error {
+	var ce *CommandError
+	if errors.As(err, &ce) && ce.Kind != KindInternal {
+		return err
+	}
+	return &CommandError{Kind: KindInternal, Message: msg, Err: err}
+}
+
+// errorReply returns the user facing reply to an error of a command. Internal
+// details are omitted, except for the errcode of homeserver errors.
+func errorReply(keyword string, err error) string {
+	msg := keyword + " failed"
+
+	var ce *CommandError
+	if errors.As(err, &ce) {
+		switch ce.Kind {
+		case KindPermission:
+			return "permission denied: " + ce.Message
+		case KindArgs:
+			return "bad arguments: " + ce.Message
+		case KindNotFound:
+			return "not found: " + ce.Message
+		case KindRefused:
+			return ce.Message
+		}
+		if ce.Message != "" {
+			msg = ce.Message
+		}
+	}
+
+	var he mautrix.HTTPError
+	if errors.As(err, &he) && he.RespError != nil {
+		msg += ": homeserver returned " + he.RespError.ErrCode
+		if he.RespError.Err != "" {
+			msg += " (" + he.RespError.Err + ")"
+		}
+		return msg
+	}
+	return msg + " due to an internal error"
+}
+
+// reportError replies to a command with its error, logging the details.
+func (b *Bot) reportError(keyword string, ev event.Event, err error) {
+	commandsExecuted.WithLabelValues(b.keywordLabel(keyword), kindOf(err).String()).Inc()
+	l := b.commandLogger(keyword, &ev)
+	if kind := kindOf(err); kind == KindInternal {
+		l.Error("command failed", "error", err)
+	} else {
+		l.Info("command rejected", "kind", kind.String(), "error", err)
+	}
+	if _, err := b.sendReply(ev, errorReply(keyword, err)); err != nil {
+		l.Error("sending error reply failed", "error", err)
+	}
+}
@@ -6,11 +6,11 @@ package fallacy
 
 import (
 	"bufio"
-	"log"
 	"strings"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 // isUnreadable returns whether a line is prefixed with an unreadable constant.
@@ -22,8 +22,15 @@ func isUnreadable(r byte) bool {
 	return false
 }
 
-func handlePolicy(ev *event.Event, f func() error) {
-	if ev.Sender == Client.UserID {
+// joined returns whether an event was received from a room fallacy is joined
+// to, rather than from the stripped state of an invite or the history of a
+// room it left.
+func joined(s mautrix.EventSource) bool {
+	return s&mautrix.EventSourceJoin != 0
+}
+
+func (b *Bot) handlePolicy(ev *event.Event, f func() error) {
+	if ev.Sender == b.Client.UserID {
 		return
 	}
 
@@ -31,49 +38,82 @@ func handlePolicy(ev *event.Event, f func() error) {
 	switch m.Recommendation {
 	case "m.ban", "org.matrix.mjolnir.ban": // TODO: remove non-spec mjolnir recommendation
 		if err := f(); err != nil {
-			sendNotice(ev.RoomID, "handling moderation policy failed with", err.Error())
+			b.sendNotice(ev.RoomID, "handling moderation policy failed with", err.Error())
 		}
 	}
 }
 
 // HandleUserPolicy handles m.policy.rule.user events by banning literals and
 // glob banning globs.
-func HandleUserPolicy(s mautrix.EventSource, ev *event.Event) {
-	e := ev.Content.AsModPolicy().Entity
-	handlePolicy(ev, options[mautrix.ReqBanUser,
-		mautrix.RespBanUser]{userID: e, roomID: ev.RoomID, action: Client.BanUser}.dispatchAction)
+func (b *Bot) HandleUserPolicy(s mautrix.EventSource, ev *event.Event) {
+	if !joined(s) {
+		return
+	}
+	m := ev.Content.AsModPolicy()
+	opt := options[mautrix.ReqBanUser, mautrix.RespBanUser]{
+		bot:    b,
+		userID: m.Entity,
+		audit: Action{
+			Kind:    "ban",
+			Actor:   ev.Sender,
+			Reason:  m.Reason,
+			Trigger: TriggerPolicy,
+		},
+		roomID: ev.RoomID,
+		action: b.Client.BanUser,
+	}
+	if b.policyCleanup {
+		opt.post = func(u id.UserID) { b.spawn(func() { b.cleanupPolicyUser(ev.Sender, u) }) }
+	}
+	b.handlePolicy(ev, opt.dispatchAction)
 }
 
 // HandleServerPolicy handles m.policy.rule.server events. Initially limited to
 // room admins but could possibly be extended to members of specific rooms.
-func HandleServerPolicy(s mautrix.EventSource, ev *event.Event) {
-	e := ev.Content.AsModPolicy().Entity
-	handlePolicy(ev, func() error { return BanServer(ev.RoomID, e) })
+func (b *Bot) HandleServerPolicy(s mautrix.EventSource, ev *event.Event) {
+	if !joined(s) {
+		return
+	}
+	m := ev.Content.AsModPolicy()
+	b.handlePolicy(ev, func() error {
+		err := b.BanServer(ev.RoomID, m.Entity)
+		b.logAction(Action{
+			Kind:    "server ACL ban",
+			Actor:   ev.Sender,
+			Target:  m.Entity,
+			RoomID:  ev.RoomID,
+			Reason:  m.Reason,
+			Trigger: TriggerPolicy,
+			Err:     err,
+		})
+		return err
+	})
 }
 
 // HandleMember handles `m.room.member` events.
-func HandleMember(s mautrix.EventSource, ev *event.Event) {
+func (b *Bot) HandleMember(s mautrix.EventSource, ev *event.Event) {
 	m := ev.Content.AsMember()
 
-	if welcome && isNewJoin(*ev) && s&mautrix.EventSourceTimeline > 0 {
+	if b.welcome && isNewJoin(*ev) && s&mautrix.EventSourceTimeline > 0 {
 		display, sender, room := m.Displayname, ev.Sender, ev.RoomID
-		if err := WelcomeMember(display, sender, room); err != nil {
-			log.Println(err)
+		if err := b.WelcomeMember(display, sender, room); err != nil {
+			b.eventLogger(ev).Error("welcoming member failed", "error", err)
 		}
 	}
 }
 
 // HandleMessage handles m.room.message events.
-func HandleMessage(s mautrix.EventSource, ev *event.Event) {
-	if ev.Sender == Client.UserID {
+func (b *Bot) HandleMessage(s mautrix.EventSource, ev *event.Event) {
+	if !joined(s) || ev.Sender == b.Client.UserID {
 		return
 	}
 
-	body := ev.Content.AsMessage().Body
+	content := ev.Content.AsMessage()
+	prefix, pills := b.commandPrefix(ev.RoomID), b.mentionPills(content)
 
 	// var once sync.Once
 
-	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner := bufio.NewScanner(strings.NewReader(content.Body))
 	for scanner.Scan() {
 		line := scanner.Text()
 		fields := strings.Fields(line)
@@ -81,7 +121,7 @@ func HandleMessage(s mautrix.EventSource, ev *event.Event) {
 			continue
 		}
 		/*
-			if l := strings.ToLower(line); firefox && strings.Contains(l, "firefox") {
+			if l := strings.ToLower(line); b.firefox && strings.Contains(l, "firefox") {
 				once.Do(func() {
 					if err := SendFallacy(ev.RoomID); err != nil {
 						log.Println(err)
@@ -89,24 +129,35 @@ func HandleMessage(s mautrix.EventSource, ev *event.Event) {
 				})
 			}
 		*/
-		if !strings.EqualFold("!fallacy", fields[0]) {
+		rest, ok := b.stripInvocation(line, prefix, pills)
+		if !ok {
+			continue
+		}
+
+		words, err := tokenize(rest)
+		if err != nil {
+			b.sendNotice(ev.RoomID, err.Error())
 			continue
 		}
-		notifyListeners(fields, *ev)
+		b.notifyListeners(words, *ev)
 	}
 }
 
 // HandleTombStone handles m.room.tombstone events, automatically joining the
 // new room.
-func HandleTombstone(_ mautrix.EventSource, ev *event.Event) {
-	var (
-		room   = ev.Content.Raw["replacement_room"].(string)
-		reason = map[string]string{"reason": "following room upgrade"}
-	)
+func (b *Bot) HandleTombstone(s mautrix.EventSource, ev *event.Event) {
+	if !joined(s) {
+		return
+	}
+	room := ev.Content.AsTombstone().ReplacementRoom
+	if room == "" {
+		return
+	}
+	reason := map[string]string{"reason": "following room upgrade"}
 
 	// join via the sender's server as we're sure that they're in the room
 	_, server, _ := ev.Sender.ParseAndDecode()
-	if _, err := Client.JoinRoom(room, server, reason); err != nil {
-		sendNotice(ev.RoomID, "attempting to join room", room, "failed with error:", err.Error())
+	if _, err := b.Client.JoinRoom(room.String(), server, reason); err != nil {
+		b.sendNotice(ev.RoomID, "attempting to join room", room.String(), "failed with error:", err.Error())
 	}
 }
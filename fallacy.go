@@ -5,15 +5,56 @@
 // Package fallacy implements the fallacy bot library.
 package fallacy
 
+//go:generate go run gen_usage.go
+
 import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/jackc/pgx/v4/pgxpool"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
+// RoomConfig is the configuration of a single room.
+type RoomConfig struct {
+	// the command prefix of the room, overriding the global prefix
+	Prefix string `json:"prefix,omitempty"`
+	// the room moderation actions in the room are logged to, overriding the
+	// global log room
+	LogRoom id.RoomID `toml:"log_room" json:"log_room,omitempty"`
+
+	// the power levels required to run commands keyed by their keyword,
+	// overriding the permission the command declares
+	Permissions map[string]int `json:"permissions,omitempty"`
+}
+
+// merge returns the configuration with the fields set in o overriding it.
+func (c RoomConfig) merge(o RoomConfig) RoomConfig {
+	if o.Prefix != "" {
+		c.Prefix = o.Prefix
+	}
+	if o.LogRoom != "" {
+		c.LogRoom = o.LogRoom
+	}
+	if len(o.Permissions) > 0 {
+		perms := make(map[string]int, len(c.Permissions)+len(o.Permissions))
+		for k, v := range c.Permissions {
+			perms[k] = v
+		}
+		for k, v := range o.Permissions {
+			perms[k] = v
+		}
+		c.Permissions = perms
+	}
+	return c
+}
+
 type Config struct {
 	// the name of the bot
 	Name string
@@ -24,86 +65,110 @@ type Config struct {
 	Homeserver string
 	// the username (mxid) to connect with, e.g., @fallacy:matrix.org
 	Username id.UserID
-	// the password to the account
+	// the password to the account, used to log in if there are no other
+	// credentials and to log in again once they are invalidated
 	Password string
+	// the access token to use instead of logging in
+	AccessToken string `toml:"access_token"`
+	// the path the credentials of a password login are saved at for reuse
+	Credentials string
+	// whether to ask for a refresh token when logging in with the password
+	RefreshTokens bool `toml:"refresh_tokens"`
 
-	// the rooms the bot responds in, omit to allow all rooms
-	PermittedRooms []id.RoomID `toml:"permitted_rooms"`
-}
+	// the Postgres connection string, omit to keep state in memory
+	Database string
+	// whether to keep the state in the account data of the bot's account
+	// instead of a database
+	AccountData bool `toml:"account_data"`
+	// the path the encryption keys are stored at, omit to disable encryption
+	CryptoStore string `toml:"crypto_store"`
 
-// New initializes the library and should be called before any other functions.
-// It is safe to call more than once, as it is only initialized once.
-func (c Config) New() error {
-	lock.Lock()
-	defer lock.Unlock()
+	// how far back to process events missed while offline, e.g. 30m, defaults
+	// to 1h
+	CatchUp string `toml:"catch_up"`
 
-	if !once {
-		client, err := mautrix.NewClient(c.Homeserver, c.Username, "")
-		if err != nil {
-			return err
-		}
+	// the address of the HTTP listener exposing metrics, omit to disable it
+	HTTPListen string `toml:"http_listen"`
 
-		Client = client
-		once = true
-		permittedRooms = c.PermittedRooms
-	}
-	return nil
-}
+	// the verbosity of the log, one of debug, info, warn or error, defaults to
+	// info
+	LogLevel string `toml:"log_level"`
+	// the format of the log, text or json, defaults to text
+	LogFormat string `toml:"log_format"`
+	// Logger receives the log instead of standard error, overriding the log
+	// level and format. It is meant for programs embedding fallacy.
+	Logger *slog.Logger `toml:"-"`
 
-func (c Config) Login() error {
-	_, err := Client.Login(&mautrix.ReqLogin{
-		DeviceID: c.DeviceID,
-		Identifier: mautrix.UserIdentifier{
-			User: string(c.Username),
-			Type: mautrix.IdentifierTypeUser,
-		},
-		InitialDeviceDisplayName: c.Name,
-		Password:                 c.Password,
-		StoreCredentials:         true,
-		Type:                     mautrix.AuthTypePassword,
-	})
-	return err
-}
+	// the appservice configuration, omit to sync as a normal user
+	Appservice Appservice
 
-func enableFirefox(b bool) {
-	lock.Lock()
-	defer lock.Unlock()
-	firefox = b
-}
+	// the command prefix, defaults to !fallacy
+	Prefix string
+	// additional command aliases, mapping an alias to a command keyword
+	Aliases map[string]string
 
-func enableWelcome(b bool) {
-	lock.Lock()
-	defer lock.Unlock()
-	welcome = b
-}
+	// the rooms the bot responds in, omit to allow all rooms
+	PermittedRooms []id.RoomID `toml:"permitted_rooms"`
+
+	// the per-endpoint-class rate limits, omit to use the defaults
+	RateLimits RateLimits `toml:"rate_limits"`
+	// the workers handling events, omit to use the defaults
+	Dispatch Dispatch
+
+	// the users administering fallacy itself, who may override safeguards
+	Admins []id.UserID
+	// the users globs may never match
+	ProtectedUsers []id.UserID `toml:"protected_users"`
+	// the limits of glob matches, omit to use the defaults
+	Safeguards Safeguards
 
-var defaultHandles = map[string][]Callback{
-	"ban":    {{BanUser, 1}},
-	"import": {{ImportList, 1}},
-	"mute":   {{MuteUser, 1}},
-	"pin":    {{Function: PinMessage}},
-	"purge":  {{Function: CommandPurge}},
-	"say":    {{SayMessage, 1}},
-	"umute":  {{UnmuteUser, 1}},
+	// the room moderation actions are logged to, omit to disable logging
+	LogRoom id.RoomID `toml:"log_room"`
+
+	// the room specific configuration keyed by room ID
+	Rooms map[id.RoomID]RoomConfig
+
+	// whether to redact the history of users banned via policy lists in every
+	// moderated room
+	PolicyCleanup bool `toml:"policy_cleanup"`
 }
 
-var (
-	// mutex protecting this block
+// Bot is a fallacy bot owning its client, commands, storage and settings.
+// Multiple bots may run in one process.
+type Bot struct {
+	// mutex protecting the settings
 	lock sync.RWMutex
 
-	// initialize this block one time only
-	once bool
+	// whether the bot has been configured
+	configured bool
+	// the configuration of the bot
+	config Config
 
-	// Client is the currently connected Client
+	// Client is the client of the bot
 	Client *mautrix.Client
 
-	// handles are the current handlers
-	handles = defaultHandles
+	// logger receives the log of the bot
+	logger *slog.Logger
+
+	// handles are the registered commands
+	handles map[string][]Callback
+	// aliases map command aliases to their keyword
+	aliases map[string]string
 
-	// limit are the allowed requests/second
-	limit = time.NewTicker(time.Millisecond * 200).C
+	// the global command prefix
+	prefix string
 
-	pool pgxpool.Pool
+	// the global moderation log room
+	logRoom id.RoomID
+
+	// limiter rate limits all requests made by Client
+	limiter *rateLimiter
+
+	// store persists the state of the bot
+	store Store
+
+	// how far back events missed while offline are processed
+	catchUpWindow time.Duration
 
 	// some room specific settings, should be migrated...
 	firefox, welcome bool
@@ -111,4 +176,194 @@ var (
 	rules []string
 
 	permittedRooms []id.RoomID
-)
+
+	// the fallacy admins and the users globs may never match
+	admins, protectedUsers []id.UserID
+	// the limits of glob matches
+	safeguards Safeguards
+
+	// whether policy list bans also clean up the user's history
+	policyCleanup bool
+
+	// the room specific configuration
+	rooms map[id.RoomID]RoomConfig
+
+	// the actions awaiting confirmation
+	confirmLock   sync.Mutex
+	confirmations map[confirmKey]*confirmation
+
+	// the current session
+	authLock sync.Mutex
+	session  credentials
+
+	// the registration of the appservice, nil if the bot syncs as a normal
+	// user
+	registration *appservice.Registration
+
+	health     healthState
+	crypto     cryptoState
+	shutdown   shutdownState
+	dispatcher dispatcher
+	breakers   breakers
+
+	// mux is the handler of the HTTP listener
+	mux *http.ServeMux
+	// server is the HTTP listener, nil if it is disabled
+	server *http.Server
+	// httpErr receives the error the HTTP listener failed with
+	httpErr chan error
+}
+
+// newBot returns an unconfigured bot with the default commands.
+func newBot() *Bot {
+	b := &Bot{
+		aliases:       make(map[string]string, len(defaultAliases)),
+		logger:        slog.Default(),
+		store:         newMemStore(),
+		catchUpWindow: defaultCatchUp,
+		confirmations: make(map[confirmKey]*confirmation),
+		mux:           http.NewServeMux(),
+		httpErr:       make(chan error, 1),
+	}
+	b.handles = b.defaultHandles()
+	for alias, keyword := range defaultAliases {
+		b.aliases[alias] = keyword
+	}
+	b.handleHTTP()
+	return b
+}
+
+// NewBot returns a bot with the configuration.
+func NewBot(c Config) (*Bot, error) {
+	b := newBot()
+	if err := b.configure(c); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// configure creates the client of the bot with the configuration. Only the
+// first configuration is applied.
+func (b *Bot) configure(c Config) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.configured {
+		return nil
+	}
+
+	logger, err := newLogger(c)
+	if err != nil {
+		return err
+	}
+	b.logger = logger
+
+	client, err := mautrix.NewClient(c.Homeserver, c.Username, "")
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c.Database != "" && c.AccountData:
+		return errors.New("database and account_data are mutually exclusive")
+	case c.Database != "":
+		s, err := newPgStore(c.Database, logger)
+		if err != nil {
+			return err
+		}
+		b.store = s
+	case c.AccountData:
+		b.store = newAccountStore(client, logger)
+	default:
+		logger.Warn("neither database nor account_data is configured, the moderation history is kept in memory and lost on restart")
+		logger.Warn("the sync token is kept in memory, events sent while fallacy is offline are not caught up on after a restart")
+	}
+
+	if c.CatchUp != "" {
+		d, err := time.ParseDuration(c.CatchUp)
+		if err != nil {
+			return err
+		}
+		b.catchUpWindow = d
+	}
+
+	if c.Appservice.Registration != "" && c.HTTPListen == "" {
+		return errors.New("appservice mode requires http_listen")
+	}
+
+	if c.HTTPListen != "" {
+		if err := b.listen(c.HTTPListen); err != nil {
+			return err
+		}
+	}
+
+	b.limiter = newRateLimiter(c.RateLimits, client.Client.Transport, logger)
+	client.Client.Transport = &reauthenticator{bot: b, next: b.limiter}
+	client.Store = newStorer(b)
+
+	b.Client = client
+	b.configured = true
+	b.config = c
+	b.permittedRooms = c.PermittedRooms
+	b.policyCleanup = c.PolicyCleanup
+	b.rooms = c.Rooms
+	b.prefix = c.Prefix
+	b.logRoom = c.LogRoom
+	b.admins = c.Admins
+	b.protectedUsers = c.ProtectedUsers
+	b.safeguards = c.Safeguards
+	for alias, keyword := range c.Aliases {
+		b.aliases[strings.ToLower(alias)] = strings.ToLower(keyword)
+	}
+	return nil
+}
+
+// Login logs in with the access token, the saved credentials or the password,
+// in that order of preference.
+func (b *Bot) Login() error {
+	err := b.login()
+	b.setLoggedIn(err == nil)
+	if err != nil || b.config.CryptoStore == "" {
+		return err
+	}
+	return b.setupCrypto(b.config.CryptoStore)
+}
+
+func (b *Bot) enableFirefox(enable bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.firefox = enable
+}
+
+func (b *Bot) enableWelcome(enable bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.welcome = enable
+}
+
+// roomConfig returns the configuration of a room, overridden by the settings
+// stored for it.
+func (b *Bot) roomConfig(roomID id.RoomID) RoomConfig {
+	b.lock.RLock()
+	c, s := b.rooms[roomID], b.store
+	b.lock.RUnlock()
+
+	stored, err := s.RoomSettings(roomID)
+	if err != nil {
+		b.roomLogger(roomID).Error("fetching room settings failed", "error", err)
+		return c
+	}
+	return c.merge(stored)
+}
+
+// handleRoomSettings updates the cached settings of a room when they change
+// in its account data.
+func (b *Bot) handleRoomSettings(_ mautrix.EventSource, ev *event.Event) {
+	cache, ok := b.store.(interface{ setRoomSettings(id.RoomID, RoomConfig) })
+	if !ok {
+		return
+	}
+	if c, ok := ev.Content.Parsed.(*RoomConfig); ok {
+		cache.setRoomSettings(ev.RoomID, *c)
+	}
+}
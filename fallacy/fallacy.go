@@ -5,10 +5,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"math/rand"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -22,46 +24,86 @@ const usage = `
 ) _)/    \/ (_/\/ (_/\/    \( (__  )  / 
 (__) \_/\_/\____/\____/\_/\_/ \___)(__/  
 
-Usage: fallacy <config file>`
+Usage: fallacy <config file>
+       fallacy -g <config file>    generate the appservice registration`
+
+// shutdownTimeout is how long running commands may take to finish once fallacy
+// is asked to shut down.
+const shutdownTimeout = 30 * time.Second
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 func main() {
-	if len(os.Args) < 2 {
+	args := os.Args[1:]
+	generate := len(args) > 0 && args[0] == "-g"
+	if generate {
+		args = args[1:]
+	}
+	if len(args) < 1 {
 		fmt.Fprintln(os.Stderr, usage)
 		os.Exit(1)
 	}
 
 	var c fallacy.Config
-	if _, err := toml.DecodeFile(os.Args[1], &c); err != nil {
+	if _, err := toml.DecodeFile(args[0], &c); err != nil {
 		fmt.Fprintln(os.Stderr, "decoding config file failed with", err)
 		os.Exit(1)
 	}
 
-	err := c.New()
+	if generate {
+		if err := c.GenerateRegistration(); err != nil {
+			fmt.Fprintln(os.Stderr, "generating registration failed with", err)
+			os.Exit(1)
+		}
+		fmt.Println("generated registration at", c.Appservice.Registration)
+		return
+	}
+
+	b, err := fallacy.NewBot(c)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "creating fallacy struct failed with", err)
+		fmt.Fprintln(os.Stderr, "creating fallacy bot failed with", err)
 		os.Exit(1)
 	}
 
-	err = c.Login()
+	err = b.Login()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "logging into %s failed with %v\n", c.Homeserver, err)
 		os.Exit(1)
 	}
 
-	syncer := fallacy.NewSyncer()
-	syncer.OnEventType(event.StatePolicyUser, fallacy.HandleUserPolicy)
-	syncer.OnEventType(event.StateMember, fallacy.HandleMember)
-	syncer.OnEventType(event.EventMessage, fallacy.HandleMessage)
-	syncer.OnEventType(event.StateTombstone, fallacy.HandleTombstone)
+	syncer := b.NewSyncer()
+	syncer.OnEventType(event.StatePolicyUser, b.HandleUserPolicy)
+	syncer.OnEventType(event.StateMember, b.HandleMember)
+	syncer.OnEventType(event.EventMessage, b.HandleMessage)
+	syncer.OnEventType(event.StateTombstone, b.HandleTombstone)
+	syncer.OnEventType(event.EventReaction, b.HandleReaction)
 
-	old := mautrix.OldEventIgnorer{UserID: fallacy.Client.UserID}
+	old := mautrix.OldEventIgnorer{UserID: b.Client.UserID}
 	old.Register(syncer)
-	fallacy.Client.Syncer = syncer
 
-	if err := fallacy.Client.Sync(); err != nil {
-		log.Println("Sync() returned", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	done := make(chan error, 1)
+	go func() { done <- b.Run(syncer) }()
+
+	logger := b.Logger()
+	select {
+	case err := <-done:
+		if err != nil {
+			logger.Error("Run() returned", "error", err)
+		}
+	case <-ctx.Done():
+		logger.Info("shutting down, waiting for running commands", "timeout", shutdownTimeout)
+	}
+	// a second signal kills fallacy right away
+	stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := b.Shutdown(ctx); err != nil {
+		logger.Error("shutting down failed", "error", err)
+		os.Exit(1)
 	}
 }
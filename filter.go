@@ -37,9 +37,24 @@ var stateType = []event.Type{
 	event.StateSpaceParent,
 }
 
+// timelineTypes are the event types fallacy handles in timelines.
+var timelineTypes = []event.Type{
+	event.EventMessage,
+	event.EventReaction,
+	event.EventEncrypted,
+	event.StateEncryption,
+	event.StateMember,
+	event.StatePolicyServer,
+	event.StatePolicyUser,
+	event.StateTombstone,
+}
+
 // purgeFilter is the standard filter for purging messages, omitting state events.
+// Encrypted events pass the filter and are redacted without being decrypted, as
+// a redaction only needs their ID.
 var purgeFilter = &mautrix.FilterPart{LazyLoadMembers: true, NotTypes: stateType}
 
+// userFilter is purgeFilter restricted to the events sent by user.
 func userFilter(user id.UserID) mautrix.FilterPart {
 	return mautrix.FilterPart{
 		LazyLoadMembers: true,
@@ -0,0 +1,21 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+
+// gen_usage generates USAGE.md from the registered commands.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/qua3k/fallacy"
+)
+
+func main() {
+	if err := os.WriteFile("USAGE.md", []byte(fallacy.Usage()), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import "maunium.net/go/mautrix/event"
+
+// yesFlag skips the confirmation of glob matches.
+var yesFlag = Flag{
+	Name:  "yes",
+	Short: 'y',
+	Usage: "act on glob matches without asking for confirmation",
+}
+
+// forceFlag overrides the safeguards of glob matches.
+var forceFlag = Flag{
+	Name:  "force",
+	Usage: "override the glob safeguards, fallacy admins only",
+}
+
+// defaultHandles returns the commands a bot starts with.
+func (b *Bot) defaultHandles() map[string][]Callback {
+	return map[string][]Callback{
+		"ban": {{
+			Function: b.BanUser,
+			Synopsis: "Ban users matching a glob or MXID.",
+			Description: `
+If the supplied glob is a literal MXID, it will resort to preemptively banning
+the user rather than iterating over the members list. Globs first reply with
+the matched members and are only banned once you confirm.`,
+			Permission: PermBan,
+			Examples: []string{
+				"!fallacy ban @spammer:example.org spam",
+				"!fallacy ban @*:evil.example.org",
+			},
+			Args:   []Arg{{Name: "glob"}},
+			Flags:  []Flag{yesFlag, forceFlag},
+			Reason: true,
+		}},
+		"cleanup": {{
+			Function: b.CleanupUser,
+			Synopsis: "Redact the history of a user in every moderated room.",
+			Description: `
+The messages sent by the user are redacted in every room fallacy moderates and
+that you administer. With --ban, rooms where you or fallacy lack the ban power
+level, or where the user's power level isn't below yours, are skipped.`,
+			Permission: PermRedact,
+			Examples: []string{
+				"!fallacy cleanup @spammer:example.org",
+				"!fallacy cleanup --ban @spammer:example.org spam",
+			},
+			Args: []Arg{{Name: "mxid"}},
+			Flags: []Flag{{
+				Name:  "ban",
+				Short: 'b',
+				Usage: "also ban the user from those rooms with the given reason",
+			}},
+			Reason: true,
+		}},
+		"confirm": {{
+			Function:   b.ConfirmAction,
+			Synopsis:   "Confirm your pending glob ban or kick in this room.",
+			Permission: PermAnyone,
+			Description: `
+Glob bans and kicks reply with a preview of the matched members first. Run this
+or react to the preview with ✅ within two minutes to carry out the action.`,
+			Examples: []string{"!fallacy confirm"},
+		}},
+		"history": {{
+			Function:   b.ShowHistory,
+			Synopsis:   "Show the moderation history of a user across every room.",
+			Permission: PermAdmin,
+			Description: `
+Lists the warnings, mutes, kicks, bans and purges of the user in every room
+fallacy moderates, newest first, with their timestamps, reasons and the acting
+admins.`,
+			Examples: []string{
+				"!fallacy history @spammer:example.org",
+				"!fallacy history --limit 50 @spammer:example.org",
+			},
+			Args: []Arg{{Name: "mxid"}},
+			Flags: []Flag{{
+				Name:  "limit",
+				Short: 'n',
+				Value: true,
+				Usage: "the amount of records to show, defaults to 20",
+			}},
+		}},
+		"import": {{
+			Function: b.ImportList,
+			Synopsis: "Import the ban list of another room.",
+			Description: `
+fallacy joins the room, copies its user moderation policies into this room and
+bans the joined members matching them.`,
+			Permission: PermBan,
+			Examples:   []string{"!fallacy import #banlist:example.org"},
+			Args:       []Arg{{Name: "room"}},
+		}},
+		"mute": {{
+			Function: b.MuteUser,
+			Synopsis: "Mute a user by demoting them below the message power level.",
+			Description: `
+This feature is seriously flawed due to how it works. fallacy must use power
+levels to demote/promote users to properly prevent them from sending messages;
+when used on an admin it renders them unable to unmute themselves or use their
+moderation tools, resulting in disastrous consequences.`,
+			Permission: PermEvent(event.StatePowerLevels),
+			Examples:   []string{"!fallacy mute @loud:example.org"},
+			Args:       []Arg{{Name: "mxid"}},
+		}},
+		"pin": {{
+			Function:   b.PinMessage,
+			Synopsis:   "Pin the message you replied to.",
+			Permission: PermEvent(event.StatePinnedEvents),
+			Examples:   []string{"!fallacy pin"},
+		}},
+		"purge": {{
+			Function: b.CommandPurge,
+			Synopsis: "Purge messages newer than a reply, or those of a user.",
+			Description: `
+This command can be used two ways:
+1.  replying and deleting messages from all users
+1.  deleting messages from a specific user, with optional limit
+
+The first option deletes all messages newer and including the message you
+replied to. The second option deletes all messages from a specific user, with
+an optional limit on the messages to purge. Omit the limit to purge every
+message of the user.`,
+			Permission: PermRedact,
+			Examples: []string{
+				"!fallacy purge",
+				"!fallacy purge @spammer:example.org 50",
+			},
+			Args: []Arg{{Name: "mxid", Optional: true}, {Name: "count", Optional: true}},
+		}},
+		"say": {{
+			Function:   b.SayMessage,
+			Synopsis:   "Make fallacy say something.",
+			Permission: PermAdmin,
+			Examples:   []string{"!fallacy say hello world"},
+			Reason:     true,
+			ReasonName: "text",
+		}},
+		"warn": {{
+			Function:   b.WarnUser,
+			Synopsis:   "Warn a user, recording it in their history.",
+			Permission: PermAdmin,
+			Examples:   []string{"!fallacy warn @loud:example.org stop shouting"},
+			Args:       []Arg{{Name: "mxid"}},
+			Reason:     true,
+		}},
+		"status": {{
+			Function: b.ShowStatus,
+			Synopsis: "Check the permissions fallacy has in this room.",
+			Description: `
+Reports whether fallacy has the ban, redact, power levels, server ACL and pin
+permissions it needs in the room and which features missing ones disable.`,
+			Permission: PermAdmin,
+			Examples:   []string{"!fallacy status"},
+		}},
+		"umute": {{
+			Function:   b.UnmuteUser,
+			Synopsis:   "Unmute a user muted with the mute command.",
+			Permission: PermEvent(event.StatePowerLevels),
+			Examples:   []string{"!fallacy umute @loud:example.org"},
+			Args:       []Arg{{Name: "mxid"}},
+		}},
+		"help": {{
+			Function:   b.Help,
+			Synopsis:   "List the available commands or show the usage of one.",
+			Permission: PermAnyone,
+			Examples:   []string{"!fallacy help", "!fallacy help purge"},
+			Args:       []Arg{{Name: "command", Optional: true}},
+		}},
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// staleSync is how long after the last successful sync fallacy is no longer
+// considered ready.
+const staleSync = 2 * time.Minute
+
+// pingTimeout is how long the health endpoints wait for the store to respond.
+const pingTimeout = 2 * time.Second
+
+// healthState tracks the state reported by the health endpoints.
+type healthState struct {
+	mu       sync.RWMutex
+	loggedIn bool
+	lastSync time.Time
+}
+
+func (b *Bot) setLoggedIn(loggedIn bool) {
+	b.health.mu.Lock()
+	defer b.health.mu.Unlock()
+	b.health.loggedIn = loggedIn
+}
+
+func (b *Bot) setSynced() {
+	b.health.mu.Lock()
+	defer b.health.mu.Unlock()
+	b.health.lastSync = time.Now()
+}
+
+// healthReport is the body of the health endpoints.
+type healthReport struct {
+	LoggedIn bool       `json:"logged_in"`
+	LastSync *time.Time `json:"last_sync"`
+	Database string     `json:"database"`
+	Ready    bool       `json:"ready"`
+}
+
+// checkHealth returns the current health of fallacy, giving up on pinging the
+// store when ctx is done.
+func (b *Bot) checkHealth(ctx context.Context) healthReport {
+	b.health.mu.RLock()
+	r := healthReport{LoggedIn: b.health.loggedIn}
+	if t := b.health.lastSync; !t.IsZero() {
+		r.LastSync = &t
+	}
+	b.health.mu.RUnlock()
+
+	b.lock.RLock()
+	appservice := b.registration != nil
+	s := b.store
+	b.lock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	r.Database = "ok"
+	if err := s.Ping(ctx); err != nil {
+		// the error may reveal the location or credentials of the store
+		b.logger.Error("pinging store failed", "error", err)
+		r.Database = "store unavailable"
+	}
+
+	// the homeserver only pushes transactions when there are events
+	synced := appservice || (r.LastSync != nil && time.Since(*r.LastSync) < staleSync)
+	r.Ready = r.LoggedIn && synced && r.Database == "ok" && !b.stopping()
+	return r
+}
+
+// serveHealth writes the health report, failing with 503 if ready is set and
+// fallacy is not ready.
+func (b *Bot) serveHealth(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r := b.checkHealth(req.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if ready && !r.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(r)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"sort"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// syntax describes the command line syntax shared by every command.
+const syntax = `Commands are invoked with the ` + "`" + defaultPrefix + "`" + ` prefix, which may be configured
+globally or per room, or by starting a message with a mention of fallacy.
+
+Arguments are separated by whitespace; wrap an argument in double quotes to
+include spaces, escaping quotes inside with a backslash. Flags are passed as
+` + "`--name`" + ` or in their short form as ` + "`-n`" + `, and flags taking a value accept either
+` + "`--name value` or `--name=value`" + `. Any words following the arguments of a command
+form its reason. Everything after a lone ` + "`--`" + ` is never treated as a flag.
+
+` + "```" + `
+    !fallacy ban @spammer:example.org posting "free crypto" links
+    !fallacy cleanup -b @spammer:example.org spam
+` + "```"
+
+// usage returns the synopsis line of a command, e.g.
+// "!fallacy ban <glob> [reason]".
+func (c Callback) usage(prefix, keyword string) string {
+	words := []string{prefix, keyword}
+	for _, f := range c.Flags {
+		flag := "--" + f.Name
+		if f.Value {
+			flag += " <" + f.Name + ">"
+		}
+		words = append(words, "["+flag+"]")
+	}
+	for _, a := range c.Args {
+		if a.Optional {
+			words = append(words, "["+a.Name+"]")
+			continue
+		}
+		words = append(words, "<"+a.Name+">")
+	}
+	if c.Reason {
+		name := c.ReasonName
+		if name == "" {
+			name = "reason"
+		}
+		words = append(words, "["+name+"]")
+	}
+	return strings.Join(words, " ")
+}
+
+// markdown returns the detailed usage of a command with its aliases as
+// Markdown, with headings of the specified level.
+func (c Callback) markdown(prefix, keyword string, aliases []string, level int) string {
+	var b strings.Builder
+	heading := strings.Repeat("#", level) + " "
+
+	b.WriteString(heading + keyword + "\n\n")
+	if c.Synopsis != "" {
+		b.WriteString(c.Synopsis + "\n\n")
+	}
+	b.WriteString("**Format:**\n```\n    " + c.usage(prefix, keyword) + "\n```\n\n")
+	if c.Description != "" {
+		b.WriteString(strings.TrimSpace(c.Description) + "\n\n")
+	}
+
+	if len(c.Flags) > 0 {
+		b.WriteString("**Flags:**\n\n")
+		for _, f := range c.Flags {
+			b.WriteString("*   `--" + f.Name + "`")
+			if f.Short != 0 {
+				b.WriteString(", `-" + string(f.Short) + "`")
+			}
+			if f.Usage != "" {
+				b.WriteString(": " + f.Usage)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("**Permission:** " + c.permission().Name + "\n\n")
+
+	if len(aliases) > 0 {
+		sort.Strings(aliases)
+		b.WriteString("**Aliases:** `" + strings.Join(aliases, "`, `") + "`\n\n")
+	}
+
+	if len(c.Examples) > 0 {
+		b.WriteString("**Examples:**\n```\n")
+		for _, e := range c.Examples {
+			if strings.HasPrefix(e, defaultPrefix+" ") {
+				e = prefix + e[len(defaultPrefix):]
+			}
+			b.WriteString("    " + e + "\n")
+		}
+		b.WriteString("```\n\n")
+	}
+	return b.String()
+}
+
+// keywords returns the registered keywords in sorted order.
+func (b *Bot) keywords() []string {
+	k := make([]string, 0, len(b.handles))
+	for keyword := range b.handles {
+		k = append(k, keyword)
+	}
+	sort.Strings(k)
+	return k
+}
+
+// commandList returns a Markdown list of the registered commands.
+func (b *Bot) commandList(prefix string) string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	var sb strings.Builder
+	sb.WriteString("**Commands:**\n\n")
+	for _, k := range b.keywords() {
+		for _, c := range b.handles[k] {
+			sb.WriteString("*   `" + c.usage(prefix, k) + "`")
+			if c.Synopsis != "" {
+				sb.WriteString(": " + c.Synopsis)
+			}
+			sb.WriteString("\n")
+		}
+	}
+	sb.WriteString("\nRun `" + prefix + " help <command>` for the detailed usage of a command.")
+	return sb.String()
+}
+
+// commandHelp returns the detailed usage of a registered command as Markdown,
+// or false if the command is not registered.
+func (b *Bot) commandHelp(prefix, word string) (string, bool) {
+	keyword, c, ok := b.resolve(word)
+	if !ok {
+		return "", false
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	aliases := b.aliasesOf(keyword)
+
+	var sb strings.Builder
+	for _, cb := range c {
+		sb.WriteString(cb.markdown(prefix, keyword, aliases, 4))
+	}
+	return sb.String(), true
+}
+
+// Usage returns the usage guide of every registered command as Markdown. It is
+// used to generate USAGE.md.
+func (b *Bot) Usage() string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	var sb strings.Builder
+	sb.WriteString("# Usage Guide\n\n")
+	sb.WriteString("<!-- Code generated by gen_usage.go; DO NOT EDIT. -->\n\n")
+	sb.WriteString("## Table of Contents\n\n")
+	sb.WriteString("*   [Command Syntax](#command-syntax)\n")
+
+	k := b.keywords()
+	for _, keyword := range k {
+		sb.WriteString("*   [" + keyword + "](#" + keyword + ")\n")
+	}
+	sb.WriteString("\n## Command Syntax\n\n" + syntax + "\n\n")
+
+	for _, keyword := range k {
+		for _, c := range b.handles[keyword] {
+			sb.WriteString(c.markdown(defaultPrefix, keyword, b.aliasesOf(keyword), 2))
+		}
+	}
+	return strings.TrimSpace(sb.String()) + "\n"
+}
+
+// Help replies with the list of registered commands, or the detailed usage of
+// a command.
+func (b *Bot) Help(args Args, ev event.Event) error {
+	prefix := b.commandPrefix(ev.RoomID)
+
+	text := b.commandList(prefix)
+	if keyword := args.Arg(0); keyword != "" {
+		h, ok := b.commandHelp(prefix, keyword)
+		if !ok {
+			return NotFound(keyword + " is not a valid command!")
+		}
+		text = h
+	}
+
+	content := format.RenderMarkdown(text, true, false)
+	content.MsgType = event.MsgNotice
+	content.RelatesTo = &event.RelatesTo{
+		Type:    event.RelReply,
+		EventID: ev.ID,
+	}
+	if _, err := b.sendMessage(ev.RoomID, &content); err != nil {
+		return Failed("could not send reply into room", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+// defaultHistoryLimit is the amount of records shown by the history command
+// when no limit is passed.
+const defaultHistoryLimit = 20
+
+// volatileHistory notes that the history only covers the current run of
+// fallacy.
+const volatileHistory = "Only actions since fallacy started are known, the history is not persisted without a database or account_data."
+
+// markdown returns a Markdown list item describing the record.
+func (r Record) markdown() string {
+	var b strings.Builder
+	b.WriteString("*   " + r.Time.UTC().Format("2006-01-02 15:04 MST"))
+	b.WriteString(" **" + r.Kind + "** in `" + r.RoomID.String() + "`")
+	b.WriteString(" by " + r.Actor.String())
+	if r.Trigger != "" && r.Trigger != TriggerCommand {
+		b.WriteString(" (" + string(r.Trigger) + ")")
+	}
+	if r.Reason != "" {
+		b.WriteString(": " + r.Reason)
+	}
+	if r.Error != "" {
+		b.WriteString(" — failed")
+	}
+	return b.String()
+}
+
+// ShowHistory replies with the moderation history of a user across every
+// room.
+func (b *Bot) ShowHistory(args Args, ev event.Event) error {
+	user := id.UserID(args.Arg(0))
+	if _, _, err := user.Parse(); err != nil {
+		return errNotUser
+	}
+
+	limit := defaultHistoryLimit
+	if l, ok := args.Flag("limit"); ok {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			return BadArgs("not a valid limit")
+		}
+		limit = n
+	}
+
+	records, err := b.store.History(user, limit)
+	if err != nil {
+		return Failed("fetching history failed", err)
+	}
+
+	if len(records) == 0 {
+		if b.volatile() {
+			b.sendNotice(ev.RoomID, "No moderation history for", user.String()+".", volatileHistory)
+			return nil
+		}
+		b.sendNotice(ev.RoomID, "No moderation history for", user.String())
+		return nil
+	}
+
+	lines := []string{"**Moderation history of " + user.String() + ":**", ""}
+	for _, r := range records {
+		lines = append(lines, r.markdown())
+	}
+	if b.volatile() {
+		lines = append(lines, "", "_"+volatileHistory+"_")
+	}
+
+	content := format.RenderMarkdown(strings.Join(lines, "\n"), true, false)
+	content.MsgType = event.MsgNotice
+	if _, err := b.sendMessage(ev.RoomID, &content); err != nil {
+		return Failed("could not send history into room", err)
+	}
+	return nil
+}
+
+// WarnUser warns a user, recording the warning in their history.
+func (b *Bot) WarnUser(args Args, ev event.Event) error {
+	user := id.UserID(args.Arg(0))
+	if _, _, err := user.Parse(); err != nil {
+		return errNotUser
+	}
+
+	msg := []string{user.String() + ", you have been warned by", ev.Sender.String()}
+	if args.Reason != "" {
+		msg = append(msg, "for:", args.Reason)
+	}
+	_, err := b.sendMessage(ev.RoomID, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    strings.Join(msg, " "),
+	})
+
+	b.logAction(Action{
+		Kind:    "warn",
+		Actor:   ev.Sender,
+		Target:  user.String(),
+		RoomID:  ev.RoomID,
+		Reason:  args.Reason,
+		Trigger: TriggerCommand,
+		Err:     err,
+	})
+	if err != nil {
+		return Failed("could not warn user", err)
+	}
+	return nil
+}
@@ -0,0 +1,556 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package fakehs implements a fake Matrix homeserver for end-to-end tests.
+//
+// The server implements the client-server endpoints fallacy uses on top of a
+// scriptable in-memory room model. Tests set up users and rooms, drive the bot
+// and then assert the resulting state of the rooms.
+package fakehs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// awaitPoll is how often Await checks its condition without events being sent.
+const awaitPoll = 10 * time.Millisecond
+
+// Server is a fake homeserver listening on a local address.
+type Server struct {
+	*httptest.Server
+
+	// Name is the server name of the homeserver, the domain of its IDs.
+	Name string
+
+	// mutex protecting the fields below
+	mu sync.Mutex
+
+	users   map[id.UserID]*user
+	tokens  map[string]id.UserID
+	rooms   map[id.RoomID]*room
+	aliases map[id.RoomAlias]id.RoomID
+	// accountData is the content of the account data of users
+	accountData map[accountDataKey]json.RawMessage
+	// filters are the sync filters uploaded by users, by ID
+	filters map[string]syncFilter
+
+	// stream is every event in the order it was sent, indexed by sync tokens
+	stream []*event.Event
+	// seq numbers the IDs handed out
+	seq int
+	// changed is closed and replaced whenever the stream changes
+	changed chan struct{}
+	// asURL is the URL transactions are pushed to
+	asURL string
+	// limited is the amount of requests still answered with M_LIMIT_EXCEEDED,
+	// asking to retry after retryAfter
+	limited    int
+	retryAfter time.Duration
+	// protected are the events redactions fail on
+	protected map[id.EventID]bool
+}
+
+// user is an account on the server.
+type user struct {
+	password string
+	display  string
+}
+
+// accountDataKey identifies account data of a user, global if the room is
+// empty.
+type accountDataKey struct {
+	user id.UserID
+	room id.RoomID
+	t    string
+}
+
+// room is a room on the server.
+type room struct {
+	id id.RoomID
+	// timeline is every event of the room, oldest first
+	timeline []*event.Event
+	// state maps event types and state keys to the current state events
+	state map[string]map[string]*event.Event
+}
+
+// New starts a fake homeserver with the server name. It must be closed once
+// the test is done.
+func New(name string) *Server {
+	s := &Server{
+		Name:    name,
+		users:   make(map[id.UserID]*user),
+		tokens:  make(map[string]id.UserID),
+		rooms:   make(map[id.RoomID]*room),
+		aliases: make(map[id.RoomAlias]id.RoomID),
+		changed: make(chan struct{}),
+
+		accountData: make(map[accountDataKey]json.RawMessage),
+		filters:     make(map[string]syncFilter),
+		protected:   make(map[id.EventID]bool),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// content returns the event content of a value, which is marshalled unless it
+// is raw JSON already.
+func content(v interface{}) event.Content {
+	var b []byte
+	switch v := v.(type) {
+	case json.RawMessage:
+		b = v
+	case []byte:
+		b = v
+	default:
+		b, _ = json.Marshal(v)
+	}
+
+	var c event.Content
+	if err := json.Unmarshal(b, &c); err != nil || c.Raw == nil {
+		json.Unmarshal([]byte("{}"), &c)
+	}
+	return c
+}
+
+// clone returns a deep copy of an event, safe to use without the lock.
+func clone(ev *event.Event) *event.Event {
+	if ev == nil {
+		return nil
+	}
+	b, _ := json.Marshal(ev)
+	var c event.Event
+	json.Unmarshal(b, &c)
+	return &c
+}
+
+// nextID returns a new ID with the sigil. The lock must be held.
+func (s *Server) nextID(sigil string) string {
+	s.seq++
+	return fmt.Sprintf("%s%d:%s", sigil, s.seq, s.Name)
+}
+
+// notify wakes up the waiters on the stream. The lock must be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// appendEvent sends an event into a room, updating the state if a state key
+// is passed. The lock must be held.
+func (s *Server) appendEvent(r *room, sender id.UserID, t string, stateKey *string, c interface{}) *event.Event {
+	class := event.MessageEventType
+	if stateKey != nil {
+		class = event.StateEventType
+	}
+
+	ev := &event.Event{
+		ID:        id.EventID(s.nextID("$")),
+		RoomID:    r.id,
+		Sender:    sender,
+		Type:      event.Type{Type: t, Class: class},
+		StateKey:  stateKey,
+		Timestamp: time.Now().UnixMilli(),
+		Content:   content(c),
+	}
+	r.timeline = append(r.timeline, ev)
+	if stateKey != nil {
+		if r.state[t] == nil {
+			r.state[t] = make(map[string]*event.Event)
+		}
+		r.state[t][*stateKey] = ev
+	}
+	s.stream = append(s.stream, ev)
+	s.notify()
+	return ev
+}
+
+// setAccountData sets account data of a user, global if the room is empty.
+// The change is sent down the sync stream of the user, the event carrying its
+// owner as the sender. The lock must be held.
+func (s *Server) setAccountData(userID id.UserID, roomID id.RoomID, t string, c interface{}) {
+	b, ok := c.(json.RawMessage)
+	if !ok {
+		b, _ = json.Marshal(c)
+	}
+	s.accountData[accountDataKey{userID, roomID, t}] = b
+
+	s.stream = append(s.stream, &event.Event{
+		RoomID:  roomID,
+		Sender:  userID,
+		Type:    event.Type{Type: t, Class: event.AccountDataEventType},
+		Content: content(b),
+	})
+	s.notify()
+}
+
+// setState sends a state event into a room. The lock must be held.
+func (s *Server) setState(r *room, sender id.UserID, t, stateKey string, c interface{}) *event.Event {
+	return s.appendEvent(r, sender, t, &stateKey, c)
+}
+
+// setMembership changes the membership of a user in a room. The lock must be
+// held.
+func (s *Server) setMembership(r *room, sender, target id.UserID, m event.Membership, reason string) *event.Event {
+	c := map[string]interface{}{"membership": m}
+	if u, ok := s.users[target]; ok && m == event.MembershipJoin && u.display != "" {
+		c["displayname"] = u.display
+	}
+	if reason != "" {
+		c["reason"] = reason
+	}
+	return s.setState(r, sender, event.StateMember.Type, target.String(), c)
+}
+
+// stateEvent returns the current state event of the type and state key.
+func (r *room) stateEvent(t, stateKey string) *event.Event {
+	return r.state[t][stateKey]
+}
+
+// membership returns the membership of a user in the room.
+func (r *room) membership(user id.UserID) event.Membership {
+	ev := r.stateEvent(event.StateMember.Type, user.String())
+	if ev == nil {
+		return event.MembershipLeave
+	}
+	m, _ := ev.Content.Raw["membership"].(string)
+	return event.Membership(m)
+}
+
+// powerLevels returns the current power levels of the room.
+func (r *room) powerLevels() *event.PowerLevelsEventContent {
+	var pl event.PowerLevelsEventContent
+	if ev := r.stateEvent(event.StatePowerLevels.Type, ""); ev != nil {
+		json.Unmarshal(ev.Content.VeryRaw, &pl)
+	}
+	return &pl
+}
+
+// joined returns the joined members of the room.
+func (r *room) joined() (users []id.UserID) {
+	for key, ev := range r.state[event.StateMember.Type] {
+		if m, _ := ev.Content.Raw["membership"].(string); m == string(event.MembershipJoin) {
+			users = append(users, id.UserID(key))
+		}
+	}
+	return
+}
+
+// Register creates an account with the localpart and password, returning its
+// user ID.
+func (s *Server) Register(localpart, password string) id.UserID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userID := id.NewUserID(localpart, s.Name)
+	s.users[userID] = &user{password: password}
+	return userID
+}
+
+// SetDisplayName sets the display name of a user.
+func (s *Server) SetDisplayName(userID id.UserID, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[userID]; ok {
+		u.display = name
+	}
+}
+
+// Invalidate invalidates every access token of a user, forcing them to log in
+// again.
+func (s *Server) Invalidate(userID id.UserID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, u := range s.tokens {
+		if u == userID {
+			delete(s.tokens, token)
+		}
+	}
+}
+
+// RateLimit answers the next n authenticated requests with M_LIMIT_EXCEEDED,
+// asking the client to retry after d.
+func (s *Server) RateLimit(n int, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limited, s.retryAfter = n, d
+}
+
+// Protect makes redactions of the event fail with M_FORBIDDEN.
+func (s *Server) Protect(eventID id.EventID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.protected[eventID] = true
+}
+
+// AddAppservice registers an application service acting as sender with the
+// token asToken, whose transactions are pushed to url.
+func (s *Server) AddAppservice(sender id.UserID, asToken, url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[asToken] = sender
+	s.asURL = url
+}
+
+// Push pushes the events to the application service in the transaction txnID,
+// authenticated with hsToken, and returns the status code of the response.
+func (s *Server) Push(hsToken, txnID string, events ...*event.Event) (int, error) {
+	s.mu.Lock()
+	u := s.asURL + "/_matrix/app/v1/transactions/" + url.PathEscape(txnID)
+	s.mu.Unlock()
+
+	if events == nil {
+		events = []*event.Event{}
+	}
+	body, err := json.Marshal(map[string][]*event.Event{"events": events})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+hsToken)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// CreateRoom creates a room with the creator at power level 100 and joins the
+// members to it, returning its ID.
+func (s *Server) CreateRoom(creator id.UserID, members ...id.UserID) id.RoomID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.createRoom(creator, nil)
+	for _, m := range members {
+		s.setMembership(r, m, m, event.MembershipJoin, "")
+	}
+	return r.id
+}
+
+// createRoom creates a room, overriding the default power levels with the
+// override if it is not nil. The lock must be held.
+func (s *Server) createRoom(creator id.UserID, override map[string]interface{}) *room {
+	r := &room{
+		id:    id.RoomID(s.nextID("!")),
+		state: make(map[string]map[string]*event.Event),
+	}
+	s.rooms[r.id] = r
+
+	s.setState(r, creator, event.StateCreate.Type, "", map[string]interface{}{"creator": creator})
+	s.setMembership(r, creator, creator, event.MembershipJoin, "")
+
+	pl := map[string]interface{}{
+		"users": map[id.UserID]int{creator: 100},
+	}
+	for k, v := range override {
+		pl[k] = v
+	}
+	s.setState(r, creator, event.StatePowerLevels.Type, "", pl)
+	return r
+}
+
+// SetAlias points a room alias at a room.
+func (s *Server) SetAlias(alias id.RoomAlias, roomID id.RoomID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aliases[alias] = roomID
+}
+
+// Join joins a user to a room.
+func (s *Server) Join(roomID id.RoomID, userID id.UserID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.rooms[roomID]; ok {
+		s.setMembership(r, userID, userID, event.MembershipJoin, "")
+	}
+}
+
+// Invite invites a user to a room.
+func (s *Server) Invite(roomID id.RoomID, sender, userID id.UserID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.rooms[roomID]; ok {
+		s.setMembership(r, sender, userID, event.MembershipInvite, "")
+	}
+}
+
+// Kick removes a user from a room.
+func (s *Server) Kick(roomID id.RoomID, sender, userID id.UserID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.rooms[roomID]; ok {
+		s.setMembership(r, sender, userID, event.MembershipLeave, "")
+	}
+}
+
+// Send sends an event with the content into a room, returning a copy of it.
+func (s *Server) Send(roomID id.RoomID, sender id.UserID, t event.Type, c interface{}) *event.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	return clone(s.appendEvent(r, sender, t.Type, nil, c))
+}
+
+// SetState sends a state event with the content into a room, returning a
+// copy of it.
+func (s *Server) SetState(roomID id.RoomID, sender id.UserID, t event.Type, stateKey string, c interface{}) *event.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	return clone(s.setState(r, sender, t.Type, stateKey, c))
+}
+
+// SetPowerLevel sets the power level of a user in a room.
+func (s *Server) SetPowerLevel(roomID id.RoomID, userID id.UserID, level int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return
+	}
+	pl := r.powerLevels()
+	pl.SetUserLevel(userID, level)
+	s.setState(r, r.stateEvent(event.StateCreate.Type, "").Sender, event.StatePowerLevels.Type, "", pl)
+}
+
+// State returns a copy of the current state event of the type and state key
+// in a room, or nil if there is none.
+func (s *Server) State(roomID id.RoomID, t event.Type, stateKey string) *event.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	return clone(r.stateEvent(t.Type, stateKey))
+}
+
+// Membership returns the membership of a user in a room.
+func (s *Server) Membership(roomID id.RoomID, userID id.UserID) event.Membership {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return event.MembershipLeave
+	}
+	return r.membership(userID)
+}
+
+// PowerLevels returns the current power levels of a room.
+func (s *Server) PowerLevels(roomID id.RoomID) *event.PowerLevelsEventContent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	return r.powerLevels()
+}
+
+// Timeline returns copies of the events of a room, oldest first.
+func (s *Server) Timeline(roomID id.RoomID) []*event.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	evs := make([]*event.Event, len(r.timeline))
+	for i, ev := range r.timeline {
+		evs[i] = clone(ev)
+	}
+	return evs
+}
+
+// Redacted returns whether an event of a room has been redacted.
+func (s *Server) Redacted(roomID id.RoomID, eventID id.EventID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return false
+	}
+	for _, ev := range r.timeline {
+		if ev.ID == eventID {
+			return ev.Unsigned.RedactedBecause != nil
+		}
+	}
+	return false
+}
+
+// SetAccountData sets account data of a user, global if the room is empty.
+func (s *Server) SetAccountData(userID id.UserID, roomID id.RoomID, t string, c interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setAccountData(userID, roomID, t, c)
+}
+
+// AccountData returns the content of account data of a user, global if the
+// room is empty, or nil if there is none.
+func (s *Server) AccountData(userID id.UserID, roomID id.RoomID, t string) json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(json.RawMessage(nil), s.accountData[accountDataKey{userID, roomID, t}]...)
+}
+
+// NextBatch returns the sync token of the current position of the stream.
+func (s *Server) NextBatch() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return streamToken(len(s.stream))
+}
+
+// Await waits until cond returns true, checking it whenever an event is sent
+// and periodically for conditions on state outside of the server, and returns
+// false if it didn't within the timeout.
+func (s *Server) Await(timeout time.Duration, cond func() bool) bool {
+	deadline := time.After(timeout)
+	tick := time.NewTicker(awaitPoll)
+	defer tick.Stop()
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+
+		if cond() {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-tick.C:
+		case <-deadline:
+			return cond()
+		}
+	}
+}
@@ -0,0 +1,794 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fakehs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// maxPoll is the longest a sync request is held open.
+	maxPoll = 5 * time.Second
+	// initialTimeline is the amount of timeline events of an initial sync.
+	initialTimeline = 20
+)
+
+// streamToken returns the sync token of a position in the stream.
+func streamToken(pos int) string {
+	return "s" + strconv.Itoa(pos)
+}
+
+// errorResponse is a Matrix error response.
+type errorResponse struct {
+	status int
+	code   string
+	msg    string
+}
+
+var (
+	errUnknownToken = &errorResponse{http.StatusUnauthorized, "M_UNKNOWN_TOKEN", "unknown access token"}
+	errForbidden    = &errorResponse{http.StatusForbidden, "M_FORBIDDEN", "insufficient power level"}
+	errNotFound     = &errorResponse{http.StatusNotFound, "M_NOT_FOUND", "not found"}
+	errBadJSON      = &errorResponse{http.StatusBadRequest, "M_BAD_JSON", "malformed request body"}
+	errUnrecognized = &errorResponse{http.StatusNotFound, "M_UNRECOGNIZED", "unrecognized request"}
+	errUserInUse    = &errorResponse{http.StatusBadRequest, "M_USER_IN_USE", "user ID already taken"}
+)
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// reply writes the response of a handler.
+func reply(w http.ResponseWriter, v interface{}, e *errorResponse) {
+	if e != nil {
+		writeJSON(w, e.status, &mautrix.RespError{ErrCode: e.code, Err: e.msg})
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// match returns whether the path segments match the pattern, in which "*"
+// matches any segment.
+func match(segs []string, pattern ...string) bool {
+	if len(segs) != len(pattern) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != segs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// accessToken returns the access token of a request.
+func accessToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// ServeHTTP serves the client-server API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/_matrix/client/")
+	if rest == r.URL.EscapedPath() {
+		reply(w, nil, errUnrecognized)
+		return
+	}
+
+	segs := strings.Split(rest, "/")
+	for i := range segs {
+		segs[i], _ = url.PathUnescape(segs[i])
+	}
+	if match(segs, "versions") {
+		reply(w, map[string][]string{"versions": {"v1.1", "v1.2"}}, nil)
+		return
+	}
+	// drop the version
+	segs = segs[1:]
+
+	if match(segs, "login") {
+		v, e := s.login(r)
+		reply(w, v, e)
+		return
+	}
+
+	s.mu.Lock()
+	sender, ok := s.tokens[accessToken(r)]
+	limited := ok && s.limited > 0
+	if limited {
+		s.limited--
+	}
+	retryAfter := s.retryAfter
+	s.mu.Unlock()
+	if !ok {
+		reply(w, nil, errUnknownToken)
+		return
+	}
+	if limited {
+		writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"errcode":        "M_LIMIT_EXCEEDED",
+			"error":          "too many requests",
+			"retry_after_ms": retryAfter.Milliseconds(),
+		})
+		return
+	}
+
+	if match(segs, "sync") {
+		s.sync(w, r, sender)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		v interface{}
+		e *errorResponse
+	)
+	switch {
+	case match(segs, "account", "whoami"):
+		v = map[string]id.UserID{"user_id": sender}
+	case match(segs, "register"):
+		// only application services reach this, registering their existing
+		// sender
+		e = errUserInUse
+	case match(segs, "user", "*", "filter"):
+		v, e = s.uploadFilter(r)
+	case match(segs, "joined_rooms"):
+		v = s.joinedRooms(sender)
+	case match(segs, "join", "*"), match(segs, "rooms", "*", "join"):
+		v, e = s.join(sender, segs[1])
+	case match(segs, "createRoom"):
+		v, e = s.handleCreateRoom(r, sender)
+	case match(segs, "directory", "room", "*"):
+		v, e = s.resolveAlias(id.RoomAlias(segs[2]))
+	case match(segs, "profile", "*", "displayname"):
+		v, e = s.displayName(id.UserID(segs[1]))
+	case match(segs, "user", "*", "account_data", "*"):
+		v, e = s.handleAccountData(r, sender, id.UserID(segs[1]), "", segs[3])
+	case match(segs, "user", "*", "rooms", "*", "account_data", "*"):
+		v, e = s.handleAccountData(r, sender, id.UserID(segs[1]), id.RoomID(segs[3]), segs[5])
+	case len(segs) > 2 && segs[0] == "rooms":
+		rm, ok := s.rooms[id.RoomID(segs[1])]
+		if !ok {
+			e = errNotFound
+			break
+		}
+		v, e = s.roomRequest(rm, req{r, sender, segs[2:]})
+	default:
+		e = errUnrecognized
+	}
+	reply(w, v, e)
+}
+
+// req is a request to a room endpoint.
+type req struct {
+	*http.Request
+	sender id.UserID
+	// the path segments following the room ID
+	segs []string
+}
+
+// decode decodes the JSON body of the request.
+func (r req) decode(v interface{}) *errorResponse {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errBadJSON
+	}
+	return nil
+}
+
+// roomRequest serves the endpoints of a room. The lock must be held.
+func (s *Server) roomRequest(rm *room, r req) (interface{}, *errorResponse) {
+	if rm.membership(r.sender) != event.MembershipJoin {
+		return nil, &errorResponse{http.StatusForbidden, "M_FORBIDDEN", "not joined to the room"}
+	}
+
+	switch segs := r.segs; {
+	case match(segs, "state"):
+		evs := []*event.Event{}
+		for _, keys := range rm.state {
+			for _, ev := range keys {
+				evs = append(evs, ev)
+			}
+		}
+		return evs, nil
+	case match(segs, "state", "*"), match(segs, "state", "*", "*"):
+		key := ""
+		if len(segs) > 2 {
+			key = segs[2]
+		}
+		if r.Method == http.MethodPut {
+			return s.sendState(rm, r, segs[1], key)
+		}
+		ev := rm.stateEvent(segs[1], key)
+		if ev == nil {
+			return nil, errNotFound
+		}
+		return &ev.Content, nil
+	case match(segs, "send", "*", "*"):
+		return s.send(rm, r, segs[1])
+	case match(segs, "redact", "*", "*"):
+		return s.redact(rm, r, id.EventID(segs[1]))
+	case match(segs, "ban"), match(segs, "kick"), match(segs, "unban"):
+		return s.moderate(rm, r, segs[0])
+	case match(segs, "leave"):
+		s.setMembership(rm, r.sender, r.sender, event.MembershipLeave, "")
+		return struct{}{}, nil
+	case match(segs, "joined_members"):
+		joined := make(map[id.UserID]interface{})
+		for _, u := range rm.joined() {
+			joined[u] = struct{}{}
+		}
+		return map[string]interface{}{"joined": joined}, nil
+	case match(segs, "messages"):
+		return s.messages(rm, r)
+	case match(segs, "context", "*"):
+		return s.context(rm, r, id.EventID(segs[1]))
+	}
+	return nil, errUnrecognized
+}
+
+// login logs in with a password.
+func (s *Server) login(r *http.Request) (interface{}, *errorResponse) {
+	var body struct {
+		mautrix.ReqLogin
+		User string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, errBadJSON
+	}
+
+	name := body.Identifier.User
+	if name == "" {
+		name = body.User
+	}
+	userID := id.UserID(name)
+	if !strings.HasPrefix(name, "@") {
+		userID = id.NewUserID(name, s.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok || u.password != body.Password {
+		return nil, &errorResponse{http.StatusForbidden, "M_FORBIDDEN", "invalid username or password"}
+	}
+
+	device := body.DeviceID
+	if device == "" {
+		s.seq++
+		device = id.DeviceID("DEVICE" + strconv.Itoa(s.seq))
+	}
+	token := s.nextID("syt_")
+	s.tokens[token] = userID
+	return mautrix.RespLogin{AccessToken: token, DeviceID: device, UserID: userID}, nil
+}
+
+// joinedRooms returns the rooms the user is joined to. The lock must be held.
+func (s *Server) joinedRooms(userID id.UserID) interface{} {
+	rooms := []id.RoomID{}
+	for roomID, r := range s.rooms {
+		if r.membership(userID) == event.MembershipJoin {
+			rooms = append(rooms, roomID)
+		}
+	}
+	return mautrix.RespJoinedRooms{JoinedRooms: rooms}
+}
+
+// join joins the user to a room by its ID or alias. The lock must be held.
+func (s *Server) join(userID id.UserID, roomIDOrAlias string) (interface{}, *errorResponse) {
+	roomID := id.RoomID(roomIDOrAlias)
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		roomID = s.aliases[id.RoomAlias(roomIDOrAlias)]
+	}
+
+	r, ok := s.rooms[roomID]
+	if !ok {
+		return nil, errNotFound
+	}
+	if r.membership(userID) == event.MembershipBan {
+		return nil, &errorResponse{http.StatusForbidden, "M_FORBIDDEN", "banned from the room"}
+	}
+	if r.membership(userID) != event.MembershipJoin {
+		s.setMembership(r, userID, userID, event.MembershipJoin, "")
+	}
+	return mautrix.RespJoinRoom{RoomID: roomID}, nil
+}
+
+// handleCreateRoom creates a room. The lock must be held.
+func (s *Server) handleCreateRoom(r *http.Request, sender id.UserID) (interface{}, *errorResponse) {
+	var body struct {
+		Invite             []id.UserID            `json:"invite"`
+		Name               string                 `json:"name"`
+		RoomAliasName      string                 `json:"room_alias_name"`
+		PowerLevelOverride map[string]interface{} `json:"power_level_content_override"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, errBadJSON
+	}
+
+	rm := s.createRoom(sender, body.PowerLevelOverride)
+	if body.Name != "" {
+		s.setState(rm, sender, event.StateRoomName.Type, "", map[string]string{"name": body.Name})
+	}
+	if body.RoomAliasName != "" {
+		s.aliases[id.NewRoomAlias(body.RoomAliasName, s.Name)] = rm.id
+	}
+	for _, u := range body.Invite {
+		s.setMembership(rm, sender, u, event.MembershipInvite, "")
+	}
+	return mautrix.RespCreateRoom{RoomID: rm.id}, nil
+}
+
+// resolveAlias returns the room of an alias. The lock must be held.
+func (s *Server) resolveAlias(alias id.RoomAlias) (interface{}, *errorResponse) {
+	roomID, ok := s.aliases[alias]
+	if !ok {
+		return nil, errNotFound
+	}
+	return mautrix.RespAliasResolve{RoomID: roomID, Servers: []string{s.Name}}, nil
+}
+
+// displayName returns the display name of a user. The lock must be held.
+func (s *Server) displayName(userID id.UserID) (interface{}, *errorResponse) {
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, errNotFound
+	}
+	return mautrix.RespUserDisplayName{DisplayName: u.display}, nil
+}
+
+// canSend returns whether the user may send events of the type into the
+// room.
+// handleAccountData gets or sets account data of a user, which only the user
+// itself may access.
+func (s *Server) handleAccountData(r *http.Request, sender, userID id.UserID, roomID id.RoomID, t string) (interface{}, *errorResponse) {
+	if sender != userID {
+		return nil, errForbidden
+	}
+	if r.Method != http.MethodPut {
+		b, ok := s.accountData[accountDataKey{userID, roomID, t}]
+		if !ok {
+			return nil, errNotFound
+		}
+		return b, nil
+	}
+
+	var c json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		return nil, errBadJSON
+	}
+	s.setAccountData(userID, roomID, t, c)
+	return struct{}{}, nil
+}
+
+func (rm *room) canSend(userID id.UserID, t string, state bool) bool {
+	class := event.MessageEventType
+	if state {
+		class = event.StateEventType
+	}
+	pl := rm.powerLevels()
+	return pl.GetUserLevel(userID) >= pl.GetEventLevel(event.Type{Type: t, Class: class})
+}
+
+// sendState sends a state event into the room. The lock must be held.
+func (s *Server) sendState(rm *room, r req, t, key string) (interface{}, *errorResponse) {
+	if !rm.canSend(r.sender, t, true) {
+		return nil, errForbidden
+	}
+
+	var c json.RawMessage
+	if e := r.decode(&c); e != nil {
+		return nil, e
+	}
+	ev := s.setState(rm, r.sender, t, key, c)
+	return mautrix.RespSendEvent{EventID: ev.ID}, nil
+}
+
+// send sends a message event into the room. The lock must be held.
+func (s *Server) send(rm *room, r req, t string) (interface{}, *errorResponse) {
+	if !rm.canSend(r.sender, t, false) {
+		return nil, errForbidden
+	}
+
+	var c json.RawMessage
+	if e := r.decode(&c); e != nil {
+		return nil, e
+	}
+	ev := s.appendEvent(rm, r.sender, t, nil, c)
+	return mautrix.RespSendEvent{EventID: ev.ID}, nil
+}
+
+// redact redacts an event of the room, stripping its content. The lock must
+// be held.
+func (s *Server) redact(rm *room, r req, eventID id.EventID) (interface{}, *errorResponse) {
+	var target *event.Event
+	for _, ev := range rm.timeline {
+		if ev.ID == eventID {
+			target = ev
+		}
+	}
+	if target == nil {
+		return nil, errNotFound
+	}
+
+	pl := rm.powerLevels()
+	if target.Sender != r.sender && pl.GetUserLevel(r.sender) < pl.Redact() || s.protected[eventID] {
+		return nil, errForbidden
+	}
+
+	var body mautrix.ReqRedact
+	r.decode(&body)
+
+	ev := s.appendEvent(rm, r.sender, event.EventRedaction.Type, nil, map[string]string{"reason": body.Reason})
+	ev.Redacts = eventID
+	target.Content = content(nil)
+	target.Unsigned.RedactedBecause = ev
+	return mautrix.RespSendEvent{EventID: ev.ID}, nil
+}
+
+// moderate bans, kicks or unbans a user from the room. The lock must be held.
+func (s *Server) moderate(rm *room, r req, action string) (interface{}, *errorResponse) {
+	var body struct {
+		UserID id.UserID `json:"user_id"`
+		Reason string    `json:"reason"`
+	}
+	if e := r.decode(&body); e != nil {
+		return nil, e
+	}
+
+	pl := rm.powerLevels()
+	level, membership := pl.Ban(), event.MembershipBan
+	switch action {
+	case "kick":
+		level, membership = pl.Kick(), event.MembershipLeave
+		if rm.membership(body.UserID) != event.MembershipJoin {
+			return nil, &errorResponse{http.StatusForbidden, "M_FORBIDDEN", "the user is not joined"}
+		}
+	case "unban":
+		membership = event.MembershipLeave
+	}
+
+	actor := pl.GetUserLevel(r.sender)
+	if actor < level || (action != "unban" && actor <= pl.GetUserLevel(body.UserID)) {
+		return nil, errForbidden
+	}
+	s.setMembership(rm, r.sender, body.UserID, membership, body.Reason)
+	return struct{}{}, nil
+}
+
+// filterPart is the part of a room event filter the server honours.
+type filterPart struct {
+	Types    []string    `json:"types"`
+	NotTypes []string    `json:"not_types"`
+	Senders  []id.UserID `json:"senders"`
+}
+
+// syncFilter is the part of a sync filter the server honours.
+type syncFilter struct {
+	AccountData filterPart `json:"account_data"`
+}
+
+// uploadFilter stores a sync filter, returning its ID. The lock must be held.
+func (s *Server) uploadFilter(r *http.Request) (interface{}, *errorResponse) {
+	var f syncFilter
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		return nil, errBadJSON
+	}
+	s.seq++
+	filterID := strconv.Itoa(s.seq)
+	s.filters[filterID] = f
+	return map[string]string{"filter_id": filterID}, nil
+}
+
+// syncFilter returns the sync filter of the filter query parameter, either the
+// ID of an uploaded filter or the filter itself. The lock must be held.
+func (s *Server) syncFilter(param string) (f syncFilter) {
+	if strings.HasPrefix(param, "{") {
+		json.Unmarshal([]byte(param), &f)
+		return
+	}
+	return s.filters[param]
+}
+
+// parseFilter parses the filter query parameter of a request.
+func parseFilter(r *http.Request) (f filterPart) {
+	if q := r.URL.Query().Get("filter"); q != "" {
+		json.Unmarshal([]byte(q), &f)
+	}
+	return
+}
+
+// matches returns whether the event passes the filter.
+func (f filterPart) matches(ev *event.Event) bool {
+	contains := func(list []string, t string) bool {
+		for _, s := range list {
+			if s == t {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(f.Types) > 0 && !contains(f.Types, ev.Type.Type) {
+		return false
+	}
+	if contains(f.NotTypes, ev.Type.Type) {
+		return false
+	}
+	if len(f.Senders) > 0 {
+		for _, s := range f.Senders {
+			if s == ev.Sender {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// token returns the pagination token of a position in a timeline, i.e. the
+// boundary before the event at that index.
+func token(pos int) string {
+	return "t" + strconv.Itoa(pos)
+}
+
+// parseToken returns the position of a pagination token, or def if it is
+// empty or malformed.
+func parseToken(t string, def int) int {
+	if n, err := strconv.Atoi(strings.TrimPrefix(t, "t")); err == nil && strings.HasPrefix(t, "t") {
+		return n
+	}
+	return def
+}
+
+// paginate returns up to limit events of the timeline passing the filter,
+// starting at the position and going backwards if dir is 'b', with the
+// position it stopped at.
+func paginate(timeline []*event.Event, pos int, dir byte, limit int, f filterPart) ([]*event.Event, int) {
+	if pos > len(timeline) {
+		pos = len(timeline)
+	}
+
+	chunk := []*event.Event{}
+	for len(chunk) < limit {
+		if dir == 'b' {
+			if pos <= 0 {
+				break
+			}
+			pos--
+			if ev := timeline[pos]; f.matches(ev) {
+				chunk = append(chunk, ev)
+			}
+			continue
+		}
+		if pos >= len(timeline) {
+			break
+		}
+		if ev := timeline[pos]; f.matches(ev) {
+			chunk = append(chunk, ev)
+		}
+		pos++
+	}
+	return chunk, pos
+}
+
+// messages paginates the timeline of the room. The lock must be held.
+func (s *Server) messages(rm *room, r req) (interface{}, *errorResponse) {
+	q := r.URL.Query()
+
+	dir := byte('b')
+	if q.Get("dir") == "f" {
+		dir = 'f'
+	}
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+
+	from := 0
+	if dir == 'b' {
+		from = len(rm.timeline)
+	}
+	from = parseToken(q.Get("from"), from)
+
+	chunk, end := paginate(rm.timeline, from, dir, limit, parseFilter(r.Request))
+	return mautrix.RespMessages{Start: token(from), Chunk: chunk, End: token(end)}, nil
+}
+
+// context returns the events surrounding an event of the room. The lock must
+// be held.
+func (s *Server) context(rm *room, r req, eventID id.EventID) (interface{}, *errorResponse) {
+	pos := -1
+	for i, ev := range rm.timeline {
+		if ev.ID == eventID {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		return nil, errNotFound
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 0 {
+		limit = 10
+	}
+	f := parseFilter(r.Request)
+	before, start := paginate(rm.timeline, pos, 'b', limit/2, f)
+	after, end := paginate(rm.timeline, pos+1, 'f', limit-limit/2, f)
+	return mautrix.RespContext{
+		Start:        token(start),
+		EventsBefore: before,
+		Event:        rm.timeline[pos],
+		EventsAfter:  after,
+		End:          token(end),
+	}, nil
+}
+
+// sync serves a sync request, holding it open until there are new events or
+// the timeout expires. The since token is the position in the stream.
+func (s *Server) sync(w http.ResponseWriter, r *http.Request, userID id.UserID) {
+	q := r.URL.Query()
+	since, initial := 0, q.Get("since") == ""
+	if !initial {
+		since, _ = strconv.Atoi(strings.TrimPrefix(q.Get("since"), "s"))
+	}
+
+	timeout, _ := strconv.Atoi(q.Get("timeout"))
+	wait := time.Duration(timeout) * time.Millisecond
+	if wait > maxPoll {
+		wait = maxPoll
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	expired := wait == 0
+	for {
+		s.mu.Lock()
+		if initial || expired || len(s.stream) > since {
+			break
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			expired = true
+		case <-r.Context().Done():
+			return
+		}
+	}
+	defer s.mu.Unlock()
+
+	var resp mautrix.RespSync
+	resp.NextBatch = streamToken(len(s.stream))
+	resp.Rooms.Join = make(map[id.RoomID]mautrix.SyncJoinedRoom)
+	resp.Rooms.Invite = make(map[id.RoomID]mautrix.SyncInvitedRoom)
+	resp.Rooms.Leave = make(map[id.RoomID]mautrix.SyncLeftRoom)
+
+	f := s.syncFilter(q.Get("filter"))
+	if initial {
+		s.initialSync(&resp, userID, f)
+	} else {
+		s.incrementalSync(&resp, userID, since, f)
+	}
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+// initialSync fills in the current state and the latest events of the rooms
+// the user is in, as well as the account data of the user. The lock must be
+// held.
+func (s *Server) initialSync(resp *mautrix.RespSync, userID id.UserID, f syncFilter) {
+	for roomID, rm := range s.rooms {
+		switch rm.membership(userID) {
+		case event.MembershipJoin:
+			var jr mautrix.SyncJoinedRoom
+			for _, keys := range rm.state {
+				for _, ev := range keys {
+					jr.State.Events = append(jr.State.Events, ev)
+				}
+			}
+			sort.Slice(jr.State.Events, func(i, j int) bool {
+				return jr.State.Events[i].Timestamp < jr.State.Events[j].Timestamp
+			})
+
+			start := len(rm.timeline) - initialTimeline
+			if start < 0 {
+				start = 0
+			}
+			jr.Timeline.Events = rm.timeline[start:]
+			jr.Timeline.Limited = start > 0
+			jr.Timeline.PrevBatch = token(start)
+			resp.Rooms.Join[roomID] = jr
+		case event.MembershipInvite:
+			var ir mautrix.SyncInvitedRoom
+			ir.State.Events = []*event.Event{rm.stateEvent(event.StateMember.Type, userID.String())}
+			resp.Rooms.Invite[roomID] = ir
+		}
+	}
+
+	for k, b := range s.accountData {
+		if k.user == userID {
+			s.syncAccountData(resp, userID, &event.Event{
+				RoomID:  k.room,
+				Sender:  k.user,
+				Type:    event.Type{Type: k.t, Class: event.AccountDataEventType},
+				Content: content(b),
+			}, f)
+		}
+	}
+}
+
+// syncAccountData adds an account data change to the response if it belongs
+// to the user and passes the filter, leaving out the room of room account data
+// until the user joins it. The lock must be held.
+func (s *Server) syncAccountData(resp *mautrix.RespSync, userID id.UserID, ev *event.Event, f syncFilter) {
+	if ev.Sender != userID || !f.AccountData.matches(ev) {
+		return
+	}
+	// account data events carry nothing but their type and content
+	ad := &event.Event{Type: ev.Type, Content: ev.Content}
+	if ev.RoomID == "" {
+		resp.AccountData.Events = append(resp.AccountData.Events, ad)
+		return
+	}
+	if rm, ok := s.rooms[ev.RoomID]; !ok || rm.membership(userID) != event.MembershipJoin {
+		return
+	}
+	jr := resp.Rooms.Join[ev.RoomID]
+	jr.AccountData.Events = append(jr.AccountData.Events, ad)
+	resp.Rooms.Join[ev.RoomID] = jr
+}
+
+// incrementalSync fills in the events sent since the position in the stream.
+// The lock must be held.
+func (s *Server) incrementalSync(resp *mautrix.RespSync, userID id.UserID, since int, f syncFilter) {
+	if since > len(s.stream) {
+		since = len(s.stream)
+	}
+
+	for _, ev := range s.stream[since:] {
+		if ev.Type.Class == event.AccountDataEventType {
+			s.syncAccountData(resp, userID, ev, f)
+			continue
+		}
+
+		rm := s.rooms[ev.RoomID]
+		own := ev.Type == event.StateMember && ev.StateKey != nil && *ev.StateKey == userID.String()
+
+		switch m := rm.membership(userID); {
+		case m == event.MembershipJoin:
+			jr := resp.Rooms.Join[rm.id]
+			jr.Timeline.Events = append(jr.Timeline.Events, ev)
+			resp.Rooms.Join[rm.id] = jr
+		case own && m == event.MembershipInvite:
+			var ir mautrix.SyncInvitedRoom
+			ir.State.Events = []*event.Event{ev}
+			resp.Rooms.Invite[rm.id] = ir
+		case own:
+			lr := resp.Rooms.Leave[rm.id]
+			lr.Timeline.Events = append(lr.Timeline.Events, ev)
+			resp.Rooms.Leave[rm.id] = lr
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// defaultPrefix is the command prefix used when none is configured.
+const defaultPrefix = "!fallacy"
+
+var defaultAliases = map[string]string{
+	"b":      "ban",
+	"unmute": "umute",
+}
+
+// pillRegex matches matrix.to user pills, capturing the URL encoded user ID
+// and the text of the pill.
+var pillRegex = regexp.MustCompile(`<a href=["']https://matrix\.to/#/([^"'?]+)[^"']*["']>(.*?)</a>`)
+
+// RegisterAlias registers an alias for a command keyword.
+func (b *Bot) RegisterAlias(alias, keyword string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.aliases[strings.ToLower(alias)] = strings.ToLower(keyword)
+}
+
+// resolve returns the canonical keyword and the callbacks registered for a
+// keyword or alias.
+func (b *Bot) resolve(word string) (string, []Callback, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	keyword := strings.ToLower(word)
+	if k, ok := b.aliases[keyword]; ok {
+		keyword = k
+	}
+	c, ok := b.handles[keyword]
+	return keyword, c, ok
+}
+
+// aliasesOf returns the aliases of a keyword. The lock must be held.
+func (b *Bot) aliasesOf(keyword string) (a []string) {
+	for alias, k := range b.aliases {
+		if k == keyword {
+			a = append(a, alias)
+		}
+	}
+	return
+}
+
+// commandPrefix returns the command prefix of a room.
+func (b *Bot) commandPrefix(roomID id.RoomID) string {
+	if p := b.roomConfig(roomID).Prefix; p != "" {
+		return p
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.prefix != "" {
+		return b.prefix
+	}
+	return defaultPrefix
+}
+
+// mentionPills returns the text of the pills in a message mentioning fallacy.
+func (b *Bot) mentionPills(content *event.MessageEventContent) (pills []string) {
+	if content.Format != event.FormatHTML {
+		return
+	}
+
+	for _, m := range pillRegex.FindAllStringSubmatch(content.FormattedBody, -1) {
+		user, err := url.PathUnescape(m[1])
+		if err != nil || id.UserID(user) != b.Client.UserID {
+			continue
+		}
+		if text := html.UnescapeString(m[2]); text != "" {
+			pills = append(pills, text)
+		}
+	}
+	return
+}
+
+// stripInvocation returns the remainder of a line invoking fallacy through the
+// command prefix, its MXID or a mention pill, or false if the line does not
+// invoke fallacy.
+func (b *Bot) stripInvocation(line, prefix string, pills []string) (string, bool) {
+	line = strings.TrimSpace(line)
+	fields := strings.Fields(line)
+	if len(fields) < 1 {
+		return "", false
+	}
+
+	first := strings.TrimRight(fields[0], ":,")
+	if strings.EqualFold(fields[0], prefix) || first == b.Client.UserID.String() {
+		return strings.TrimSpace(line[len(fields[0]):]), true
+	}
+
+	for _, p := range pills {
+		if strings.HasPrefix(line, p) {
+			return strings.TrimLeft(line[len(p):], ":, \t"), true
+		}
+	}
+	return "", false
+}
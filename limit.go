@@ -0,0 +1,280 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// endpointClass is the class of homeserver endpoints sharing a token bucket.
+type endpointClass int
+
+const (
+	classOther endpointClass = iota
+	classSend
+	classRedact
+	classState
+	classMember
+)
+
+// String returns the name of the class.
+func (c endpointClass) String() string {
+	switch c {
+	case classSend:
+		return "send"
+	case classRedact:
+		return "redact"
+	case classState:
+		return "state"
+	case classMember:
+		return "membership"
+	}
+	return "other"
+}
+
+// RateLimit is the configuration of a single token bucket.
+type RateLimit struct {
+	// the sustained requests/second, a non-positive rate disables limiting
+	Rate float64
+	// the amount of requests that may be made at once
+	Burst int
+}
+
+// RateLimits configures the token buckets for each class of endpoints.
+type RateLimits struct {
+	Send       RateLimit
+	Redact     RateLimit
+	State      RateLimit
+	Membership RateLimit
+	Other      RateLimit
+
+	// the amount of times a rate limited request is retried
+	Retries *int
+}
+
+// defaultRateLimits mirror the previous global limit of 5 requests/second for
+// writes, leaving reads unlimited.
+var defaultRateLimits = RateLimits{
+	Send:       RateLimit{Rate: 5, Burst: 5},
+	Redact:     RateLimit{Rate: 5, Burst: 5},
+	State:      RateLimit{Rate: 5, Burst: 5},
+	Membership: RateLimit{Rate: 5, Burst: 5},
+}
+
+// defaultRetries is the amount of times a rate limited request is retried.
+const defaultRetries = 3
+
+// bucket is a token bucket.
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	RateLimit
+}
+
+func newBucket(r RateLimit) *bucket {
+	if r.Burst < 1 {
+		r.Burst = 1
+	}
+	return &bucket{tokens: float64(r.Burst), last: time.Now(), RateLimit: r}
+}
+
+// reserve takes a token from the bucket, returning how long the caller must
+// wait before the token is valid.
+func (b *bucket) reserve() time.Duration {
+	if b.Rate <= 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.Rate
+	if max := float64(b.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.Rate * float64(time.Second))
+}
+
+// rateLimiter is a http.RoundTripper applying per-endpoint-class token buckets
+// to requests, backing off globally when the homeserver rate limits us.
+type rateLimiter struct {
+	buckets map[endpointClass]*bucket
+	retries int
+	next    http.RoundTripper
+	logger  *slog.Logger
+
+	mu    sync.Mutex
+	until time.Time // global backoff requested by the homeserver
+}
+
+func newRateLimiter(c RateLimits, next http.RoundTripper, logger *slog.Logger) *rateLimiter {
+	pick := func(r, def RateLimit) RateLimit {
+		if r == (RateLimit{}) {
+			return def
+		}
+		return r
+	}
+
+	retries := defaultRetries
+	if c.Retries != nil {
+		retries = *c.Retries
+	}
+
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	d := defaultRateLimits
+	return &rateLimiter{
+		buckets: map[endpointClass]*bucket{
+			classSend:   newBucket(pick(c.Send, d.Send)),
+			classRedact: newBucket(pick(c.Redact, d.Redact)),
+			classState:  newBucket(pick(c.State, d.State)),
+			classMember: newBucket(pick(c.Membership, d.Membership)),
+			classOther:  newBucket(pick(c.Other, d.Other)),
+		},
+		retries: retries,
+		next:    next,
+		logger:  logger,
+	}
+}
+
+// classify returns the endpoint class of a request, or false if the request
+// should not be limited at all.
+func classify(req *http.Request) (endpointClass, bool) {
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/sync"):
+		return classOther, false
+	case strings.Contains(path, "/redact/"):
+		return classRedact, true
+	case strings.Contains(path, "/send/"):
+		return classSend, true
+	case strings.Contains(path, "/state/") && req.Method == http.MethodPut:
+		return classState, true
+	case strings.Contains(path, "/join/"):
+		return classMember, true
+	}
+
+	i := strings.LastIndexByte(path, '/')
+	switch path[i+1:] {
+	case "ban", "unban", "kick", "invite", "join", "leave", "forget":
+		return classMember, true
+	}
+	return classOther, true
+}
+
+// backoff returns how long until the global backoff ends.
+func (l *rateLimiter) backoff() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Until(l.until)
+}
+
+// setBackoff makes every request wait for at least d.
+func (l *rateLimiter) setBackoff(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t := time.Now().Add(d); t.After(l.until) {
+		l.until = t
+	}
+}
+
+// wait blocks for the bucket of class and any global backoff.
+func (l *rateLimiter) wait(req *http.Request, class endpointClass) error {
+	d := l.buckets[class].reserve()
+	if b := l.backoff(); b > d {
+		d = b
+	}
+	rateLimitWaitSeconds.WithLabelValues(class.String()).Observe(d.Seconds())
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// retryAfter parses the backoff requested by a M_LIMIT_EXCEEDED response,
+// falling back to the Retry-After header and then to a second.
+func retryAfter(res *http.Response, body []byte) time.Duration {
+	var e struct {
+		RetryAfter int64 `json:"retry_after_ms"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.RetryAfter > 0 {
+		return time.Duration(e.RetryAfter) * time.Millisecond
+	}
+
+	if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		return time.Duration(s) * time.Second
+	}
+	return time.Second
+}
+
+// RoundTrip implements http.RoundTripper.
+func (l *rateLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	class, limited := classify(req)
+	if strings.HasSuffix(req.URL.Path, "/sync") {
+		start := time.Now()
+		defer func() { syncRequestSeconds.Observe(time.Since(start).Seconds()) }()
+	}
+
+	for attempt := 0; ; attempt++ {
+		if limited {
+			if err := l.wait(req, class); err != nil {
+				return nil, err
+			}
+		}
+
+		res, err := l.next.RoundTrip(req)
+		if err != nil || res.StatusCode != http.StatusTooManyRequests {
+			return res, err
+		}
+
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		res.Body = io.NopCloser(bytes.NewReader(body))
+
+		d := retryAfter(res, body)
+		l.setBackoff(d)
+		l.logger.Warn("rate limited, backing off", "path", req.URL.Path, "backoff", d)
+
+		if attempt >= l.retries || (req.Body != nil && req.GetBody == nil) {
+			return res, nil
+		}
+		if req.GetBody != nil {
+			req = req.Clone(req.Context())
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		limited = true
+	}
+}
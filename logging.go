@@ -0,0 +1,61 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// newLogger returns the logger configured by c, writing to standard error
+// unless c.Logger is set.
+func newLogger(c Config) (*slog.Logger, error) {
+	if c.Logger != nil {
+		return c.Logger, nil
+	}
+
+	var level slog.Level
+	if c.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			return nil, fmt.Errorf("invalid log_level %q", c.LogLevel)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(c.LogFormat) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log_format %q, must be text or json", c.LogFormat)
+}
+
+// Logger returns the logger of the bot.
+func (b *Bot) Logger() *slog.Logger {
+	return b.logger
+}
+
+// roomLogger returns the logger of the bot with the room ID attached.
+func (b *Bot) roomLogger(roomID id.RoomID) *slog.Logger {
+	return b.logger.With("room", roomID)
+}
+
+// eventLogger returns the logger of the bot with the room ID, event ID and
+// sender of an event attached.
+func (b *Bot) eventLogger(ev *event.Event) *slog.Logger {
+	return b.logger.With("room", ev.RoomID, "event", ev.ID, "sender", ev.Sender)
+}
+
+// commandLogger returns the logger of the bot with the fields of a command
+// invocation attached.
+func (b *Bot) commandLogger(keyword string, ev *event.Event) *slog.Logger {
+	return b.eventLogger(ev).With("command", keyword)
+}
@@ -30,7 +30,7 @@ func isNewJoin(ev event.Event) bool {
 // WelcomeMember welcomes a member via their display name. The display name is
 // calculated as per
 // https://spec.matrix.org/v1.1/Client-server-api/#calculating-the-display-name-for-a-user.
-func WelcomeMember(display string, sender id.UserID, roomID id.RoomID) (err error) {
+func (b *Bot) WelcomeMember(display string, sender id.UserID, roomID id.RoomID) (err error) {
 	senderStr := sender.String()
 
 	// if the name is just whitespace we can just use sender ID
@@ -43,7 +43,7 @@ func WelcomeMember(display string, sender id.UserID, roomID id.RoomID) (err erro
 	}
 
 	anchor := strings.Join([]string{"<a href='https://matrix.to/#/", senderStr, "'>", display, "</a>"}, "")
-	_, err = Client.SendMessageEvent(roomID, event.EventMessage, event.MessageEventContent{
+	_, err = b.sendMessage(roomID, &event.MessageEventContent{
 		Body:          welcome(display),
 		Format:        event.FormatHTML,
 		FormattedBody: welcome(anchor),
@@ -0,0 +1,129 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"maunium.net/go/mautrix/event"
+)
+
+// otherLabel is the label of values outside the known set, keeping the
+// cardinality of labels taken from events bounded.
+const otherLabel = "other"
+
+// The Prometheus metrics exposed on the HTTP listener. They are registered
+// with the default registry and thus process-wide: every Bot in a process
+// reports into the same metrics.
+var (
+	syncRequestSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fallacy_sync_request_seconds",
+		Help:    "Duration of /sync requests, including long polling.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+	syncProcessSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "fallacy_sync_process_seconds",
+		Help: "Duration of processing /sync responses.",
+	})
+	syncFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fallacy_sync_failures_total",
+		Help: "Failed /sync requests.",
+	})
+	eventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fallacy_events_processed_total",
+		Help: "Events received through /sync by type.",
+	}, []string{"type"})
+	eventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fallacy_events_dropped_total",
+		Help: "Events dropped as the dispatch queue of their room was full, by type.",
+	}, []string{"type"})
+	dispatchQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fallacy_dispatch_queued_events",
+		Help: "Events waiting for a worker to call their listeners.",
+	})
+	panicsRecovered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fallacy_panics_recovered_total",
+		Help: "Panics of handlers and commands recovered by handler.",
+	}, []string{"handler"})
+	commandsExecuted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fallacy_commands_total",
+		Help: "Commands executed by keyword and result.",
+	}, []string{"keyword", "result"})
+	moderationActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fallacy_moderation_actions_total",
+		Help: "Moderation actions taken by kind and result.",
+	}, []string{"kind", "result"})
+	redactionsQueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fallacy_redactions_queued_total",
+		Help: "Redactions queued.",
+	})
+	redactionsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fallacy_redactions_completed_total",
+		Help: "Redactions completed by result.",
+	}, []string{"result"})
+	rateLimitWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fallacy_rate_limit_wait_seconds",
+		Help:    "Time requests waited for the rate limiter by endpoint class.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"class"})
+)
+
+// typeLabel returns the label of an event type, which is any room member's to
+// choose. Types without registered content are labeled as other.
+func typeLabel(t event.Type) string {
+	if _, ok := event.TypeMap[t]; ok {
+		return t.Type
+	}
+	return otherLabel
+}
+
+// keywordLabel returns the label of a command keyword, labeling keywords that
+// aren't registered as other.
+func (b *Bot) keywordLabel(keyword string) string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if _, ok := b.handles[keyword]; ok {
+		return keyword
+	}
+	return otherLabel
+}
+
+// result returns the result label of an error.
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// handleHTTP registers the metrics and health endpoints of the HTTP listener.
+func (b *Bot) handleHTTP() {
+	b.mux.Handle("/metrics", promhttp.Handler())
+	b.mux.Handle("/healthz", b.serveHealth(false))
+	b.mux.Handle("/readyz", b.serveHealth(true))
+}
+
+// listen starts serving the HTTP listener on the address in the background.
+// The lock must be held.
+func (b *Bot) listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	b.server = &http.Server{Handler: b.mux}
+	go func(srv *http.Server) {
+		err := srv.Serve(l)
+		if !errors.Is(err, http.ErrServerClosed) {
+			b.logger.Error("HTTP listener failed", "error", err)
+		}
+		b.httpErr <- err
+	}(b.server)
+	return nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !olm
+
+package fallacy
+
+import (
+	"errors"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// cryptoState is empty as fallacy was built without Olm.
+type cryptoState struct{}
+
+// setupCrypto fails as fallacy was built without Olm.
+func (*Bot) setupCrypto(string) error {
+	return errors.New("fallacy was built without encryption support, rebuild it with -tags olm")
+}
+
+func (*Bot) flushCrypto() error {
+	return nil
+}
+
+func (*Bot) cryptoSync(*mautrix.RespSync, string) bool {
+	return true
+}
+
+func (*Bot) cryptoEvent(ev *event.Event) (*event.Event, error) {
+	return ev, nil
+}
+
+func (*Bot) encryptContent(_ id.RoomID, t event.Type, content interface{}) (event.Type, interface{}, error) {
+	return t, content, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	// a handler panicking breakerThreshold times within breakerWindow is
+	// disabled for breakerCooldown
+	breakerThreshold = 3
+	breakerWindow    = 10 * time.Minute
+	breakerCooldown  = 30 * time.Minute
+)
+
+var (
+	// errPanic is wrapped by the errors of recovered panics.
+	errPanic = errors.New("panicked")
+	// errDisabled is returned for handlers disabled by their circuit breaker.
+	errDisabled = errors.New("disabled after panicking repeatedly")
+)
+
+// breaker is the circuit breaker of a handler or command.
+type breaker struct {
+	// the times of the recent panics, oldest first
+	panics []time.Time
+	// when the handler is enabled again, zero if it is enabled
+	disabledUntil time.Time
+}
+
+// breakers holds the circuit breakers keyed by the name of their handler.
+type breakers struct {
+	mu sync.Mutex
+	m  map[string]*breaker
+}
+
+// enabled returns whether the circuit breaker of a handler lets it run.
+func (b *Bot) enabled(name string) bool {
+	b.breakers.mu.Lock()
+	defer b.breakers.mu.Unlock()
+
+	br, ok := b.breakers.m[name]
+	if !ok || br.disabledUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(br.disabledUntil) {
+		return false
+	}
+	br.disabledUntil = time.Time{}
+	br.panics = nil
+	return true
+}
+
+// recordPanic records a panic of a handler, returning whether its circuit
+// breaker disabled it.
+func (b *Bot) recordPanic(name string) bool {
+	b.breakers.mu.Lock()
+	defer b.breakers.mu.Unlock()
+
+	if b.breakers.m == nil {
+		b.breakers.m = make(map[string]*breaker)
+	}
+	br, ok := b.breakers.m[name]
+	if !ok {
+		br = &breaker{}
+		b.breakers.m[name] = br
+	}
+
+	now := time.Now()
+	recent := br.panics[:0]
+	for _, t := range br.panics {
+		if now.Sub(t) < breakerWindow {
+			recent = append(recent, t)
+		}
+	}
+	br.panics = append(recent, now)
+
+	if len(br.panics) < breakerThreshold {
+		return false
+	}
+	br.disabledUntil = now.Add(breakerCooldown)
+	return true
+}
+
+// protect calls f on behalf of the handler or command name, handling ev. A
+// panic of f is recovered, logged with its stack and reported to the log room
+// of the room of the event. It returns the error of the panic, or nil if f
+// returned normally. While the handler is disabled, f isn't called and
+// errDisabled is returned.
+func (b *Bot) protect(name string, trigger Trigger, ev *event.Event, f func()) (err error) {
+	if !b.enabled(name) {
+		b.eventLogger(ev).Debug("skipping disabled handler", "handler", name)
+		return errDisabled
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		err = fmt.Errorf("%s %w: %v", name, errPanic, r)
+		panicsRecovered.WithLabelValues(name).Inc()
+		b.eventLogger(ev).Error("handler panicked", "handler", name, "panic", r, "stack", string(debug.Stack()))
+
+		a := Action{
+			Kind:    "panic",
+			Actor:   ev.Sender,
+			Target:  name,
+			RoomID:  ev.RoomID,
+			Trigger: trigger,
+			Err:     err,
+		}
+		if b.recordPanic(name) {
+			a.Detail = fmt.Sprintf("disabled for %s after %d panics", breakerCooldown, breakerThreshold)
+			b.eventLogger(ev).Error("disabling handler", "handler", name, "cooldown", breakerCooldown)
+		}
+		b.logAction(a)
+	}()
+	f()
+	return nil
+}
+
+// handlerName returns the name of an event handler, e.g.
+// fallacy.(*Bot).HandleMessage.
+func handlerName(fn mautrix.EventHandler) string {
+	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	name = strings.TrimSuffix(name, "-fm")
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// protected returns fn wrapped by protect, disabling it when it keeps
+// panicking.
+func (b *Bot) protected(fn mautrix.EventHandler) mautrix.EventHandler {
+	name := handlerName(fn)
+	return func(source mautrix.EventSource, ev *event.Event) {
+		b.protect(name, TriggerHandler, ev, func() { fn(source, ev) })
+	}
+}
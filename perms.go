@@ -0,0 +1,71 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"math"
+	"strconv"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Permission is the power level requirement of a command.
+type Permission struct {
+	// the name of the permission, shown in help
+	Name string
+	// Level returns the power level required to run the command in a room
+	// with the specified power levels.
+	Level func(pl *event.PowerLevelsEventContent) int
+}
+
+var (
+	// PermAnyone allows anyone to run a command.
+	PermAnyone = Permission{"anyone", func(*event.PowerLevelsEventContent) int { return math.MinInt }}
+	// PermAdmin requires the lowest of the ban, kick and redact levels. It is
+	// the permission of commands that do not declare one.
+	PermAdmin = Permission{"room admin (ban, kick or redact power level)", adminLevel}
+	// PermBan requires the ban level.
+	PermBan = Permission{"ban power level", (*event.PowerLevelsEventContent).Ban}
+	// PermKick requires the kick level.
+	PermKick = Permission{"kick power level", (*event.PowerLevelsEventContent).Kick}
+	// PermRedact requires the redact level.
+	PermRedact = Permission{"redact power level", (*event.PowerLevelsEventContent).Redact}
+)
+
+// PermEvent requires the level to send an event type.
+func PermEvent(t event.Type) Permission {
+	return Permission{
+		Name: t.Type + " power level",
+		Level: func(pl *event.PowerLevelsEventContent) int {
+			return pl.GetEventLevel(t)
+		},
+	}
+}
+
+// PermLevel requires a fixed power level.
+func PermLevel(n int) Permission {
+	return Permission{
+		Name:  "power level " + strconv.Itoa(n),
+		Level: func(*event.PowerLevelsEventContent) int { return n },
+	}
+}
+
+// permission returns the permission of a callback, defaulting to PermAdmin.
+func (c Callback) permission() Permission {
+	if c.Permission.Level == nil {
+		return PermAdmin
+	}
+	return c.Permission
+}
+
+// requiredPermission returns the permission required to run a command in a
+// room, honoring the room's overrides.
+func (b *Bot) requiredPermission(roomID id.RoomID, keyword string, c Callback) Permission {
+	if lvl, ok := b.roomConfig(roomID).Permissions[keyword]; ok {
+		return PermLevel(lvl)
+	}
+	return c.permission()
+}
@@ -6,7 +6,11 @@ package fallacy
 
 import (
 	"errors"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/gobwas/glob"
 	"golang.org/x/sync/errgroup"
@@ -15,10 +19,18 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
+// defaultGlobReason is the reason of glob matches when none is given.
+const defaultGlobReason = "u just got globbed"
+
 // the options struct for banning people
 type options[T modReq, U modResp] struct {
+	bot    *Bot
 	userID string
 
+	// the action logged for every user actioned upon, its reason is passed
+	// to the homeserver
+	audit Action
+
 	// the glob compiled from userID
 	glb    glob.Glob
 	roomID id.RoomID
@@ -28,20 +40,26 @@ type options[T modReq, U modResp] struct {
 
 	// action to take if a joined member matches the userID
 	action func(id.RoomID, *T) (*U, error)
+
+	// post is optionally called with every user successfully actioned upon
+	post func(id.UserID)
+
+	// whether to override the safeguards of glob matches
+	force bool
 }
 
 // init ensures that options struct has power levels and joined_members,
 // otherwise error out
 func (o *options[T, U]) init() error {
 	if o.members == nil {
-		m, err := Client.JoinedMembers(o.roomID)
+		m, err := o.bot.Client.JoinedMembers(o.roomID)
 		if err != nil {
 			return err
 		}
 		o.members = m
 	}
 	if o.power == nil {
-		p, err := powerLevels(o.roomID)
+		p, err := o.bot.powerLevels(o.roomID)
 		if err != nil {
 			return err
 		}
@@ -59,29 +77,112 @@ type (
 	}
 )
 
+// matches returns the joined members matching the glob, omitting admins.
+func (o options[T, U]) matches() ([]id.UserID, error) {
+	if err := o.init(); err != nil {
+		return nil, err
+	}
+	lvl := adminLevel(o.power)
+
+	var users []id.UserID
+	for u := range o.members.Joined {
+		if o.glb.Match(string(u)) && o.power.GetUserLevel(u) < lvl {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+	return users, nil
+}
+
+// safeMatches returns the matches of the glob, or an error if acting upon
+// them exceeds the safeguards.
+func (o options[T, U]) safeMatches() ([]id.UserID, error) {
+	users, err := o.matches()
+	if err != nil {
+		return nil, err
+	}
+	if err := o.bot.safeguard(o.glb, users, len(o.members.Joined), o.force); err != nil {
+		return nil, o.bot.refuse(o.globAction(), err)
+	}
+	return users, nil
+}
+
+// globAction returns the action taken on the glob as a whole.
+func (o options[T, U]) globAction() Action {
+	a := o.audit
+	a.Target, a.RoomID = o.userID, o.roomID
+	if a.Reason == "" {
+		a.Reason = defaultGlobReason
+	}
+	return a
+}
+
 // globMatch is a generic function to kick or ban joined users matching the glob
-// from the room. It returns an error on the first non-nil error.
+// from the room. Every user is recorded in the history, while the log room gets
+// a single entry summarizing the glob. It returns the first non-nil error.
 func (o options[T, U]) globMatch() error {
-	if err := o.init(); err != nil {
+	users, err := o.safeMatches()
+	if err != nil {
 		return err
 	}
-	lvl := adminLevel(o.power)
+	return o.actOn(users)
+}
 
-	var g errgroup.Group
-	for user := range o.members.Joined {
+// actOn takes the action on the users matching the glob, see globMatch.
+func (o options[T, U]) actOn(users []id.UserID) error {
+	var (
+		g      errgroup.Group
+		mu     sync.Mutex
+		failed []string
+	)
+	for _, user := range users {
 		u := user
-		if !o.glb.Match(string(u)) || o.power.GetUserLevel(u) >= lvl {
-			continue
-		}
 		g.Go(func() error {
-			_, err := o.action(o.roomID, &T{
-				Reason: "u just got globbed",
-				UserID: u,
-			})
+			_, err := o.apply(u)
+			if err != nil {
+				mu.Lock()
+				failed = append(failed, u.String()+": "+err.Error())
+				mu.Unlock()
+			}
 			return err
 		})
 	}
-	return g.Wait()
+	err := g.Wait()
+
+	a := o.globAction()
+	a.Detail = strconv.Itoa(len(users)-len(failed)) + " of " + strconv.Itoa(len(users)) + " matching users"
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		a.Err = errors.New(strings.Join(failed, "; "))
+	}
+	o.bot.postAction(a)
+	return err
+}
+
+// apply takes the action on a single user and records it in the history,
+// leaving the entry in the log room to the caller.
+func (o options[T, U]) apply(u id.UserID) (Action, error) {
+	a := o.audit
+	if o.glb != nil {
+		a = o.globAction()
+		a.Detail = "matched " + o.userID
+	}
+	_, err := o.action(o.roomID, &T{Reason: a.Reason, UserID: u})
+
+	a.Target, a.RoomID, a.Err = u.String(), o.roomID, err
+	o.bot.recordAction(a)
+
+	if err == nil && o.post != nil {
+		o.post(u)
+	}
+	return a, err
+}
+
+// act takes the action on a single user, logging it.
+func (o options[T, U]) act(u id.UserID) error {
+	a, err := o.apply(u)
+	o.bot.postAction(a)
+	return err
 }
 
 // Interactively action on a user based on whether they are a glob or a MXID.
@@ -90,7 +191,7 @@ func (o options[T, U]) globMatch() error {
 // this way allows users to preemptively ban problematic users.
 func (o options[T, U]) dispatchAction() error {
 	switch {
-	case strings.Contains(o.userID, "*"), strings.Contains(o.userID, "?"):
+	case isGlob(o.userID):
 		glb, err := glob.Compile(o.userID)
 		if err != nil {
 			return err
@@ -98,48 +199,109 @@ func (o options[T, U]) dispatchAction() error {
 		o.glb = glb
 		return o.globMatch()
 	case o.userID[0] == '@':
-		_, err := o.action(o.roomID, &T{UserID: id.UserID(o.userID)})
-		return err
+		return o.act(id.UserID(o.userID))
 	}
 	return errNotUser
 }
 
-func moderateUser[T modReq, U modResp](roomID id.RoomID, userID string,
+// isGlob returns whether the user ID is a glob rather than a literal MXID.
+func isGlob(userID string) bool {
+	return strings.ContainsAny(userID, "*?")
+}
+
+// moderateUser kicks or bans the users matching a glob or MXID in the room of
+// the command. Unless yes is set, glob matches are previewed and only actioned
+// upon once the invoker confirms. Forcing overrides the safeguards and is
+// reserved to fallacy admins.
+func moderateUser[T modReq, U modResp](b *Bot, ev event.Event, userID string, a Action, yes, force bool,
 	f func(id.RoomID, *T) (*U, error)) error {
-	pl, err := powerLevels(roomID)
+	a.Target, a.RoomID = userID, ev.RoomID
+	if force && !b.isBotAdmin(ev.Sender) {
+		return b.refuse(a, Denied("only fallacy admins may --force an action"))
+	}
+
+	roomID := ev.RoomID
+	pl, err := b.powerLevels(roomID)
 	if err != nil {
 		return err
 	}
 
-	if pl.Ban() > pl.GetUserLevel(Client.UserID) {
-		return errNoPerms
+	if pl.Ban() > pl.GetUserLevel(b.Client.UserID) {
+		return b.refuse(a, errNoPerms)
 	}
 
-	jm, err := Client.JoinedMembers(roomID)
+	jm, err := b.Client.JoinedMembers(roomID)
 	if err != nil {
 		return err
 	}
 
 	opt := options[T, U]{
+		bot:     b,
 		userID:  userID,
+		audit:   a,
 		roomID:  roomID,
 		power:   pl,
 		members: jm,
 		action:  f,
+		force:   force,
+	}
+	if yes || !isGlob(userID) {
+		return opt.dispatchAction()
 	}
-	return opt.dispatchAction()
+
+	glb, err := glob.Compile(userID)
+	if err != nil {
+		return BadArgs("not a valid glob pattern!")
+	}
+	opt.glb = glb
+
+	users, err := opt.safeMatches()
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return NotFound("no joined members match " + userID)
+	}
+	return b.requestConfirmation(a.Kind, ev, users, func() error {
+		// the members and power levels may have changed since the preview
+		opt.members, opt.power = nil, nil
+		if err := opt.init(); err != nil {
+			return Failed(a.Kind+" of "+userID+" failed", err)
+		}
+		now, err := opt.safeMatches()
+		if err != nil {
+			return Failed(a.Kind+" of "+userID+" failed", err)
+		}
+		if opt.power.Ban() > opt.power.GetUserLevel(b.Client.UserID) {
+			return b.refuse(opt.globAction(), errNoPerms)
+		}
+		if !slices.Equal(now, users) {
+			return b.refuse(opt.globAction(), Refused("the members matching "+userID+
+				" changed since the preview, run the command again"))
+		}
+		if err := opt.actOn(users); err != nil {
+			return Failed(a.Kind+" of "+userID+" failed", err)
+		}
+		return nil
+	})
 }
 
-func BanUser(body []string, ev event.Event) {
-	if err := moderateUser(ev.RoomID, body[0], Client.BanUser); err != nil {
-		sendNotice(ev.RoomID, "banning user failed with", err.Error())
+// BanUser bans the users matching a glob or MXID with an optional reason.
+func (b *Bot) BanUser(args Args, ev event.Event) error {
+	a := Action{Kind: "ban", Actor: ev.Sender, Reason: args.Reason, Trigger: TriggerCommand}
+	if err := moderateUser(b, ev, args.Arg(0), a, args.Has("yes"), args.Has("force"), b.Client.BanUser); err != nil {
+		return Failed("banning user failed", err)
 	}
+	return nil
 }
 
-func KickUser(body []string, ev event.Event) {
-	if err := moderateUser(ev.RoomID, body[0], Client.KickUser); err != nil {
-		sendNotice(ev.RoomID, "kicking user failed with", err.Error())
+// KickUser kicks the users matching a glob or MXID with an optional reason.
+func (b *Bot) KickUser(args Args, ev event.Event) error {
+	a := Action{Kind: "kick", Actor: ev.Sender, Reason: args.Reason, Trigger: TriggerCommand}
+	if err := moderateUser(b, ev, args.Arg(0), a, args.Has("yes"), args.Has("force"), b.Client.KickUser); err != nil {
+		return Failed("kicking user failed", err)
 	}
+	return nil
 }
 
 func (o options[T, U]) processBans(evs map[string]*event.Event) error {
@@ -154,10 +316,11 @@ func (o options[T, U]) processBans(evs map[string]*event.Event) error {
 			continue
 		}
 		o.userID = e
+		o.audit.Reason, _ = ev.Content.Raw["reason"].(string)
 
 		switch r {
 		case "m.ban", "org.matrix.mjolnir.ban": // TODO: remove legacy mjolnir ban
-			_, err := Client.SendStateEvent(o.roomID, event.StatePolicyUser, key, &ev.Content)
+			_, err := o.bot.Client.SendStateEvent(o.roomID, event.StatePolicyUser, key, &ev.Content)
 			if err != nil {
 				return err
 			}
@@ -169,10 +332,10 @@ func (o options[T, U]) processBans(evs map[string]*event.Event) error {
 	return nil
 }
 
-func resolveRoom(roomID string) (id.RoomID, error) {
+func (b *Bot) resolveRoom(roomID string) (id.RoomID, error) {
 	switch roomID[0] {
 	case '#':
-		r, err := Client.ResolveAlias(id.RoomAlias(roomID))
+		r, err := b.Client.ResolveAlias(id.RoomAlias(roomID))
 		if err != nil {
 			return "", err
 		}
@@ -184,81 +347,77 @@ func resolveRoom(roomID string) (id.RoomID, error) {
 }
 
 // ImportList imports a banlist from another room.
-func ImportList(body []string, ev event.Event) {
-	pl, err := powerLevels(ev.RoomID)
+func (b *Bot) ImportList(args Args, ev event.Event) error {
+	pl, err := b.powerLevels(ev.RoomID)
 	if err != nil {
-		sendNotice(ev.RoomID, err.Error())
-		return
+		return Failed(errPowerLevels.Error(), err)
 	}
 
 	lvl := pl.GetEventLevel(event.StatePolicyUser)
-	if b := pl.Ban(); b > lvl {
-		lvl = b
+	if ban := pl.Ban(); ban > lvl {
+		lvl = ban
 	}
 
-	if lvl > pl.GetUserLevel(Client.UserID) {
-		sendNotice(ev.RoomID, permsMessage)
-		return
+	a := Action{Kind: "import", Actor: ev.Sender, Target: args.Arg(0), RoomID: ev.RoomID, Trigger: TriggerCommand}
+	if lvl > pl.GetUserLevel(b.Client.UserID) {
+		return b.refuse(a, errNoPerms)
 	}
 
-	roomID, err := resolveRoom(body[0])
+	roomID, err := b.resolveRoom(args.Arg(0))
 	if err != nil {
-		sendNotice(ev.RoomID, err.Error())
-		return
+		return err
 	}
 
 	if roomID == ev.RoomID {
-		sendNotice(ev.RoomID, "Refusing to import events from this room!")
-		return
+		return b.refuse(a, Refused("Refusing to import events from this room!"))
 	}
 
 	_, hs, _ := ev.Sender.ParseAndDecode()
-	if _, err := Client.JoinRoom(string(roomID), hs, nil); err != nil {
-		sendNotice(ev.RoomID, "could not join room", roomID.String(), "failed with:", err.Error())
-		return
+	if _, err := b.Client.JoinRoom(string(roomID), hs, nil); err != nil {
+		return Failed("could not join room "+roomID.String(), err)
 	}
 
-	s, err := Client.State(roomID)
+	s, err := b.Client.State(roomID)
 	if err != nil {
-		sendNotice(ev.RoomID, "could not import state from", roomID.String(), "failed with:", err.Error())
-		return
+		return Failed("could not import state from "+roomID.String(), err)
 	}
 
-	jm, err := Client.JoinedMembers(ev.RoomID)
+	jm, err := b.Client.JoinedMembers(ev.RoomID)
 	if err != nil {
-		sendNotice(ev.RoomID, errMembers.Error(), "failed with", err.Error())
-		return
+		return Failed(errMembers.Error(), err)
 	}
 
 	opt := options[mautrix.ReqBanUser, mautrix.RespBanUser]{
+		bot:     b,
+		audit:   Action{Kind: "ban", Actor: ev.Sender, Trigger: TriggerCommand},
 		roomID:  ev.RoomID,
 		members: jm,
 		power:   pl,
-		action:  Client.BanUser,
+		action:  b.Client.BanUser,
 	}
 	if err = opt.processBans(s[event.StatePolicyUser]); err != nil {
-		sendNotice(ev.RoomID, "processing bans failed with", err.Error())
-		return
+		return Failed("processing bans failed", err)
 	}
 	opt.processBans(s[event.NewEventType("m.room.rule.user")])
-	sendNotice(ev.RoomID, "Finished importing list from", body[0])
+	b.sendNotice(ev.RoomID, "Finished importing list from", args.Arg(0))
+	return nil
 }
 
-func createBanList(sender id.UserID, room string) (id.RoomID, error) {
+func (b *Bot) createBanList(sender id.UserID, room string) (id.RoomID, error) {
 	display := string(sender)
-	r, err := Client.GetDisplayName(sender)
+	r, err := b.Client.GetDisplayName(sender)
 	if err == nil {
 		display = r.DisplayName
 	}
 
-	resp, err := Client.CreateRoom(&mautrix.ReqCreateRoom{
+	resp, err := b.Client.CreateRoom(&mautrix.ReqCreateRoom{
 		Invite: []id.UserID{sender},
 		Name:   room,
 		PowerLevelOverride: &event.PowerLevelsEventContent{
 			EventsDefault: 50,
 			Users: map[id.UserID]int{
-				sender:        100,
-				Client.UserID: 50,
+				sender:          100,
+				b.Client.UserID: 50,
 			},
 		},
 		Preset: "trusted_private_chat",
@@ -268,8 +427,8 @@ func createBanList(sender id.UserID, room string) (id.RoomID, error) {
 }
 
 var (
-	errInvalidRoom = errors.New("not a valid room ID")
+	errInvalidRoom = BadArgs("not a valid room ID")
 	errMembers     = errors.New("could not fetch joined members")
-	errNotUser     = errors.New("could not ban user, not a valid glob or user id")
+	errNotUser     = BadArgs("could not ban user, not a valid glob or user id")
 	errPowerLevels = errors.New("could not fetch power levels")
 )
@@ -6,8 +6,8 @@ package fallacy
 
 import (
 	"errors"
-	"log"
 	"strconv"
+	"sync"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -18,25 +18,88 @@ import (
 // ~1000 events.
 const fetchLimit = 1000
 
+// purgeAll is the limit of purgeUser redacting every message of the user.
+const purgeAll = -1
+
 // RedactMessage only redacts message events, skipping redaction events, already
 // redacted events, and state events.
-func RedactMessage(ev event.Event) (err error) {
+func (b *Bot) RedactMessage(ev event.Event) (err error) {
 	if ev.StateKey != nil {
 		return
 	}
 
 	if ev.Type != event.EventRedaction && ev.Unsigned.RedactedBecause == nil {
-		<-limit
-		_, err = Client.RedactEvent(ev.RoomID, ev.ID, mautrix.ReqRedact{})
+		_, err = b.Client.RedactEvent(ev.RoomID, ev.ID, mautrix.ReqRedact{})
 		return
 	}
 	return
 }
 
-func redactMessage(ev event.Event) {
-	if err := RedactMessage(ev); err != nil {
-		log.Println(err)
+// redactWorkers is the amount of redactions a purge runs at once.
+const redactWorkers = 4
+
+// redactor redacts the events of a purge with a bounded amount of workers,
+// counting the events it redacted.
+type redactor struct {
+	events chan event.Event
+	wg     sync.WaitGroup
+
+	// mutex protecting redacted
+	mu       sync.Mutex
+	redacted int
+
+	// the last event queued for redaction
+	last id.EventID
+}
+
+// newRedactor starts the workers of a redactor. A shutdown waits for them.
+func (b *Bot) newRedactor() *redactor {
+	r := &redactor{events: make(chan event.Event)}
+	r.wg.Add(redactWorkers)
+	for i := 0; i < redactWorkers; i++ {
+		b.spawn(func() {
+			defer r.wg.Done()
+			for ev := range r.events {
+				err := b.RedactMessage(ev)
+				redactionsCompleted.WithLabelValues(result(err)).Inc()
+				if err != nil {
+					b.eventLogger(&ev).Error("redacting event failed", "action", "purge", "error", err)
+					continue
+				}
+				r.mu.Lock()
+				r.redacted++
+				r.mu.Unlock()
+			}
+		})
+	}
+	return r
+}
+
+// queue queues an event for redaction, waiting for a free worker.
+func (r *redactor) queue(ev event.Event) {
+	redactionsQueued.Inc()
+	r.last = ev.ID
+	r.events <- ev
+}
+
+// wait waits for the queued redactions and stops the workers, returning the
+// number of events redacted.
+func (r *redactor) wait() int {
+	close(r.events)
+	r.wg.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.redacted
+}
+
+// purgeDetail describes a purge that redacted n events for the audit log. A
+// purge interrupted by a shutdown also records the last event it got to.
+func purgeDetail(n int, last id.EventID, err error) string {
+	d := strconv.Itoa(n) + " events redacted"
+	if errors.Is(err, errShuttingDown) && last != "" {
+		d += ", interrupted after " + last.String()
 	}
+	return d
 }
 
 func validate(resp *mautrix.RespMessages, err error) (*mautrix.RespMessages, error) {
@@ -46,92 +109,148 @@ func validate(resp *mautrix.RespMessages, err error) (*mautrix.RespMessages, err
 	return resp, err
 }
 
-// PurgeUser redacts optionally a limit or all messages sent by a specified
-// user. This is implemented efficiently using a filter to only obtain the
-// events sent by the user.
-func PurgeUser(body []string, ev event.Event) {
-	user := id.UserID(body[0])
-
-	var max int
-	var limit bool
-	if len(body) > 1 {
-		i, err := strconv.Atoi(body[1])
-		if err != nil {
-			sendNotice(ev.RoomID, "not a valid integer of messages to purge")
-			return
-		}
-		max = i
-		limit = true
-	}
+// purgeUser redacts up to max messages sent by user in roomID, or all of them
+// if max is purgeAll. It returns the number of events redacted and the last
+// event it got to.
+func (b *Bot) purgeUser(roomID id.RoomID, user id.UserID, max int) (n int, last id.EventID, err error) {
+	r := b.newRedactor()
+	defer func() { n, last = r.wait(), r.last }()
 
 	filter := userFilter(user)
-	msg, err := validate(Client.Messages(ev.RoomID, "", "", 'b', &filter, fetchLimit))
+	msg, err := validate(b.Client.Messages(roomID, "", "", 'b', &filter, fetchLimit))
 
 	var prev string
-	var i int
+	queued := 0
 	for err == nil && msg.End != prev {
 		prev = msg.End
 		for _, e := range msg.Chunk {
-			if limit {
-				if i >= max {
-					sendNotice(ev.RoomID, "Purging messages done!")
-					return
-				}
-				i++
+			if max != purgeAll && queued >= max {
+				return
+			}
+			if b.stopping() {
+				err = errShuttingDown
+				return
 			}
-			go redactMessage(*e)
+			queued++
+			r.queue(*e)
 		}
-		msg, err = validate(Client.Messages(ev.RoomID, msg.End, "", 'b', &filter, fetchLimit))
+		msg, err = validate(b.Client.Messages(roomID, msg.End, "", 'b', &filter, fetchLimit))
 	}
-	log.Println("purging user messages failed with", err)
+	return
+}
+
+// PurgeUser redacts optionally a limit or all messages sent by a specified
+// user, all of them only if the limit is omitted. This is implemented
+// efficiently using a filter to only obtain the events sent by the user.
+func (b *Bot) PurgeUser(args Args, ev event.Event) error {
+	user := id.UserID(args.Arg(0))
+
+	max := purgeAll
+	if n := args.Arg(1); n != "" {
+		i, err := strconv.Atoi(n)
+		if err != nil {
+			return BadArgs("not a valid integer of messages to purge")
+		}
+		if i < 1 {
+			return BadArgs("the count of messages to purge must be at least 1")
+		}
+		max = i
+	}
+
+	n, last, err := b.purgeUser(ev.RoomID, user, max)
+	b.logAction(Action{
+		Kind:    "purge",
+		Actor:   ev.Sender,
+		Target:  user.String(),
+		RoomID:  ev.RoomID,
+		Trigger: TriggerCommand,
+		Detail:  purgeDetail(n, last, err),
+		Err:     err,
+	})
+	if errors.Is(err, errShuttingDown) {
+		return interrupted("purge", n)
+	}
+	if err != nil {
+		return Failed("purging user messages failed", err)
+	}
+	b.sendNotice(ev.RoomID, "Purging messages done!")
+	return nil
 }
 
 // PurgeMessages redacts all message events newer than the specified event ID.
 // It's loosely inspired by Telegram's SophieBot mechanics.
-func PurgeMessages(body []string, ev event.Event) {
+func (b *Bot) PurgeMessages(_ Args, ev event.Event) error {
 	relate := ev.Content.AsMessage().RelatesTo
 	if relate == nil {
-		sendNotice(ev.RoomID, "Reply to the message you want to purge!")
-		return
+		return BadArgs("Reply to the message you want to purge!")
 	}
 
-	c, err := Client.Context(ev.RoomID, relate.EventID, purgeFilter, 1)
+	c, err := b.Client.Context(ev.RoomID, relate.EventID, purgeFilter, 1)
 	if err != nil {
-		log.Println("fetching context failed with error", err)
-		return
+		return Failed("fetching context failed", err)
+	}
+	r := b.newRedactor()
+	r.queue(*c.Event)
+
+	// finish waits for the redactions and records the purge, returning the
+	// number of events redacted
+	finish := func(err error) int {
+		n := r.wait()
+		b.logAction(Action{
+			Kind:    "purge",
+			Actor:   ev.Sender,
+			Target:  "messages since " + relate.EventID.String(),
+			RoomID:  ev.RoomID,
+			Trigger: TriggerCommand,
+			Detail:  purgeDetail(n, r.last, err),
+			Err:     err,
+		})
+		return n
 	}
-	go RedactMessage(*c.Event)
 
-	msg, err := validate(Client.Messages(ev.RoomID, c.End, "", 'f', purgeFilter, fetchLimit))
+	msg, err := validate(b.Client.Messages(ev.RoomID, c.End, "", 'f', purgeFilter, fetchLimit))
 	if msg != nil {
 		msg.Chunk = append(c.EventsAfter, msg.Chunk...)
 	}
 
 	for err == nil {
 		for _, e := range msg.Chunk {
-			go redactMessage(*e)
+			if b.stopping() {
+				return interrupted("purge", finish(errShuttingDown))
+			}
+			r.queue(*e)
 			if e.ID == ev.ID {
-				sendNotice(ev.RoomID, "Purging messages done!")
-				return
+				finish(nil)
+				b.sendNotice(ev.RoomID, "Purging messages done!")
+				return nil
 			}
 		}
-		msg, err = validate(Client.Messages(ev.RoomID, msg.End, "", 'f', purgeFilter, fetchLimit))
+		msg, err = validate(b.Client.Messages(ev.RoomID, msg.End, "", 'f', purgeFilter, fetchLimit))
 	}
-	log.Println("fetching messages failed with", err)
+	finish(err)
+	return Failed("fetching messages failed", err)
 }
 
 // CommandPurge is a simple function to be invoked by the purge keyword.
-func CommandPurge(body []string, ev event.Event) {
-	if !hasPerms(ev.RoomID, event.EventRedaction) {
-		sendNotice(ev.RoomID, permsMessage)
-		return
+func (b *Bot) CommandPurge(args Args, ev event.Event) error {
+	if !b.hasPerms(ev.RoomID, event.EventRedaction) {
+		target := "messages"
+		if len(args.Positional) > 0 {
+			target = args.Arg(0)
+		}
+		return b.refuse(Action{
+			Kind:    "purge",
+			Actor:   ev.Sender,
+			Target:  target,
+			RoomID:  ev.RoomID,
+			Trigger: TriggerCommand,
+		}, errNoPerms)
 	}
 
-	if len(body) > 0 {
-		PurgeUser(body, ev)
-		return
+	if len(args.Positional) > 0 {
+		return b.PurgeUser(args, ev)
 	}
-	PurgeMessages(body, ev)
+	return b.PurgeMessages(args, ev)
 }
 
 var (
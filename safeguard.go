@@ -0,0 +1,111 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"strconv"
+
+	"github.com/gobwas/glob"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// defaultMaxFraction is the default fraction of members a glob may match.
+	defaultMaxFraction = 0.25
+	// defaultMaxCount is the default amount of members a glob may match.
+	defaultMaxCount = 50
+
+	// probeLocalpart is a localpart unlikely to be named by a glob that does
+	// not match every user of a homeserver.
+	probeLocalpart = "fallacy.safeguard-probe_4f1c"
+)
+
+// Safeguards limit the amount of members a single glob may act upon.
+type Safeguards struct {
+	// the largest fraction of joined members a glob may match, defaults to
+	// 0.25
+	MaxFraction float64 `toml:"max_fraction"`
+	// the largest amount of members a glob may match, defaults to 50
+	MaxCount int `toml:"max_count"`
+}
+
+// limits returns the safeguards with defaults applied.
+func (s Safeguards) limits() (fraction float64, count int) {
+	fraction, count = s.MaxFraction, s.MaxCount
+	if fraction <= 0 {
+		fraction = defaultMaxFraction
+	}
+	if count <= 0 {
+		count = defaultMaxCount
+	}
+	return
+}
+
+// isBotAdmin returns whether the user administers fallacy itself.
+func (b *Bot) isBotAdmin(user id.UserID) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, a := range b.admins {
+		if a == user {
+			return true
+		}
+	}
+	return false
+}
+
+// protectedMatch returns the first protected user matched by the glob, i.e.
+// fallacy itself, its admins and the configured protected users.
+func (b *Bot) protectedMatch(glb glob.Glob) (id.UserID, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if glb.Match(b.Client.UserID.String()) {
+		return b.Client.UserID, true
+	}
+	for _, list := range [][]id.UserID{b.admins, b.protectedUsers} {
+		for _, u := range list {
+			if glb.Match(u.String()) {
+				return u, true
+			}
+		}
+	}
+	return "", false
+}
+
+// matchesOwnServer returns whether the glob matches every user of the
+// homeserver of fallacy.
+func (b *Bot) matchesOwnServer(glb glob.Glob) bool {
+	_, hs, _ := b.Client.UserID.Parse()
+	return glb.Match("@"+probeLocalpart+":"+hs) || glb.Match(hs)
+}
+
+// safeguard returns an error if acting upon the users matched by the glob out
+// of the joined members exceeds the blast radius fallacy permits. Forcing
+// overrides every check but matching fallacy itself.
+func (b *Bot) safeguard(glb glob.Glob, users []id.UserID, joined int, force bool) error {
+	if u, ok := b.protectedMatch(glb); ok && (!force || u == b.Client.UserID) {
+		return Refused("Refusing to act on a glob matching the protected user " + u.String() + "!")
+	}
+	if force {
+		return nil
+	}
+
+	if b.matchesOwnServer(glb) {
+		return Refused("Refusing to act on every user of own homeserver!")
+	}
+
+	b.lock.RLock()
+	fraction, count := b.safeguards.limits()
+	b.lock.RUnlock()
+
+	// a single match is always within the fraction, even in tiny rooms
+	n := len(users)
+	if n > count || (n > 1 && float64(n)/float64(joined) > fraction) {
+		return Refused("Refusing to act on " + strconv.Itoa(n) + " of " + strconv.Itoa(joined) +
+			" members, a fallacy admin may override this with --force")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// errShuttingDown is returned by actions interrupted by a shutdown.
+var errShuttingDown = errors.New("fallacy is shutting down")
+
+// interrupted returns the error of an action interrupted by a shutdown after
+// n events.
+func interrupted(action string, n int) error {
+	return &CommandError{
+		Kind:    KindRefused,
+		Message: fmt.Sprintf("fallacy is shutting down, %s stopped after %d events", action, n),
+		Err:     errShuttingDown,
+	}
+}
+
+// shutdownState tracks the work a shutdown waits for.
+type shutdownState struct {
+	// mutex protecting stopping and cancel
+	mu       sync.Mutex
+	stopping bool
+	// cancel cancels the running sync
+	cancel context.CancelFunc
+
+	// work counts the running handlers, commands, purges and redactions
+	work sync.WaitGroup
+}
+
+// stopping returns whether the bot is shutting down.
+func (b *Bot) stopping() bool {
+	b.shutdown.mu.Lock()
+	defer b.shutdown.mu.Unlock()
+	return b.shutdown.stopping
+}
+
+// begin marks the start of processing events received from the homeserver,
+// returning false if the bot is shutting down. Every successful call must be
+// followed by a call to end.
+func (b *Bot) begin() bool {
+	b.shutdown.mu.Lock()
+	defer b.shutdown.mu.Unlock()
+	if b.shutdown.stopping {
+		return false
+	}
+	b.shutdown.work.Add(1)
+	return true
+}
+
+// end marks the end of processing events started by begin.
+func (b *Bot) end() {
+	b.shutdown.work.Done()
+}
+
+// spawn runs f in the background, making a shutdown wait for it to return.
+// A panic of f is logged instead of crashing fallacy.
+func (b *Bot) spawn(f func()) {
+	b.shutdown.work.Add(1)
+	go func() {
+		defer b.shutdown.work.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				panicsRecovered.WithLabelValues("background").Inc()
+				b.logger.Error("background work panicked", "panic", r, "stack", string(debug.Stack()))
+			}
+		}()
+		f()
+	}()
+}
+
+// syncContext returns the context of a sync canceled by a shutdown, or false
+// if the bot is already shutting down.
+func (b *Bot) syncContext() (context.Context, bool) {
+	b.shutdown.mu.Lock()
+	defer b.shutdown.mu.Unlock()
+	if b.shutdown.stopping {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.shutdown.cancel = cancel
+	return ctx, true
+}
+
+// Shutdown stops syncing and accepting commands, then waits for the running
+// commands, purges and redactions until the context is done. Once they are
+// done or the deadline passed, the HTTP listener is closed. The storage is only
+// flushed and closed if the work is done, as work still running after the
+// deadline keeps writing to it. Interrupted purges record how far they got in
+// the history.
+func (b *Bot) Shutdown(ctx context.Context) error {
+	b.shutdown.mu.Lock()
+	b.shutdown.stopping = true
+	if b.shutdown.cancel != nil {
+		b.shutdown.cancel()
+	}
+	b.shutdown.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		b.shutdown.work.Wait()
+		close(drained)
+	}()
+
+	var errs []error
+	timedOut := false
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		timedOut = true
+		errs = append(errs, fmt.Errorf("waiting for running work failed: %w", ctx.Err()))
+	}
+
+	b.lock.RLock()
+	server, s := b.server, b.store
+	b.lock.RUnlock()
+
+	if server != nil {
+		if err := server.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing HTTP listener failed: %w", err))
+		}
+	}
+	if err := b.flushCrypto(); err != nil {
+		errs = append(errs, fmt.Errorf("flushing crypto store failed: %w", err))
+	}
+	if timedOut {
+		b.logger.Warn("work is still running, leaving the store open")
+	} else if err := s.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing store failed: %w", err))
+	}
+
+	for _, err := range errs {
+		b.logger.Error("shutdown failed", "error", err)
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
@@ -10,18 +10,18 @@ import (
 )
 
 // powerLevels returns a power levels struct from the specified roomID.
-func powerLevels(roomID id.RoomID) (resp *event.PowerLevelsEventContent, err error) {
-	err = Client.StateEvent(roomID, event.StatePowerLevels, "", &resp)
+func (b *Bot) powerLevels(roomID id.RoomID) (resp *event.PowerLevelsEventContent, err error) {
+	err = b.Client.StateEvent(roomID, event.StatePowerLevels, "", &resp)
 	return
 }
 
 // acls returns an ACL struct.
-func acls(roomID id.RoomID) (resp event.ServerACLEventContent, err error) {
-	err = Client.StateEvent(roomID, event.StateServerACL, "", &resp)
+func (b *Bot) acls(roomID id.RoomID) (resp event.ServerACLEventContent, err error) {
+	err = b.Client.StateEvent(roomID, event.StateServerACL, "", &resp)
 	return
 }
 
-func roomName(roomID id.RoomID) (resp event.RoomNameEventContent, err error) {
-	err = Client.StateEvent(roomID, event.StateRoomName, "", &resp)
+func (b *Bot) roomName(roomID id.RoomID) (resp event.RoomNameEventContent, err error) {
+	err = b.Client.StateEvent(roomID, event.StateRoomName, "", &resp)
 	return
 }
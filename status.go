@@ -0,0 +1,80 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// capability is a permission fallacy needs and the features requiring it.
+type capability struct {
+	name     string
+	has      bool
+	features []string
+}
+
+// capabilities returns the permissions fallacy needs in the room of the power
+// levels.
+func (b *Bot) capabilities(pl *event.PowerLevelsEventContent) []capability {
+	level := pl.GetUserLevel(b.Client.UserID)
+	return []capability{
+		{"ban", pl.Ban() <= level, []string{"ban", "import", "policy list bans"}},
+		{"redact", pl.Redact() <= level && b.canSend(pl, event.EventRedaction),
+			[]string{"purge", "cleanup", "policy cleanup"}},
+		{"power levels", b.canSend(pl, event.StatePowerLevels), []string{"mute", "umute"}},
+		{"server ACL", b.canSend(pl, event.StateServerACL), []string{"server policy bans"}},
+		{"pin", b.canSend(pl, event.StatePinnedEvents), []string{"pin"}},
+	}
+}
+
+// ShowStatus replies with the permissions fallacy has in the room and the
+// features left disabled by missing ones.
+func (b *Bot) ShowStatus(_ Args, ev event.Event) error {
+	pl, err := b.powerLevels(ev.RoomID)
+	if err != nil {
+		return Failed(errPowerLevels.Error(), err)
+	}
+
+	lines := []string{"**fallacy status in this room:**", ""}
+	if pl.GetUserLevel(b.Client.UserID) >= adminLevel(pl) {
+		lines = append(lines, "fallacy is a room admin.", "")
+	} else {
+		lines = append(lines, "fallacy is **not** a room admin.", "")
+	}
+
+	var disabled []string
+	for _, c := range b.capabilities(pl) {
+		if c.has {
+			lines = append(lines, "*   ✅ "+c.name)
+			continue
+		}
+		lines = append(lines, "*   ❌ "+c.name)
+		disabled = append(disabled, c.features...)
+	}
+
+	lines = append(lines, "")
+	if len(disabled) > 0 {
+		lines = append(lines, "Disabled features: "+strings.Join(disabled, ", "))
+	} else {
+		lines = append(lines, "All features are available.")
+	}
+
+	if h := b.checkHealth(context.Background()); h.LastSync != nil {
+		lines = append(lines, "", "Last sync "+time.Since(*h.LastSync).Round(time.Second).String()+
+			" ago, database "+h.Database+".")
+	}
+
+	content := format.RenderMarkdown(strings.Join(lines, "\n"), true, false)
+	content.MsgType = event.MsgNotice
+	if _, err := b.sendMessage(ev.RoomID, &content); err != nil {
+		return Failed("could not send status into room", err)
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"maunium.net/go/mautrix/id"
+)
+
+// Record is a moderation action stored in the history.
+type Record struct {
+	Time    time.Time
+	Kind    string
+	Actor   id.UserID
+	Target  string
+	RoomID  id.RoomID
+	Reason  string
+	Trigger Trigger
+	Detail  string
+	// the error the action failed with, empty if it succeeded
+	Error string
+}
+
+// record returns the history record of an action taken now.
+func (a Action) record() Record {
+	r := Record{
+		Time:    time.Now(),
+		Kind:    a.Kind,
+		Actor:   a.Actor,
+		Target:  a.Target,
+		RoomID:  a.RoomID,
+		Reason:  a.Reason,
+		Trigger: a.Trigger,
+		Detail:  a.Detail,
+	}
+	if a.Err != nil {
+		r.Error = a.Err.Error()
+	}
+	return r
+}
+
+// Store persists the state of fallacy.
+type Store interface {
+	// AddRecord adds a record to the moderation history.
+	AddRecord(r Record) error
+	// History returns up to limit records targeting a user, newest first.
+	History(user id.UserID, limit int) ([]Record, error)
+	// Ping returns an error if the store is unreachable before ctx is done.
+	Ping(ctx context.Context) error
+
+	// Value returns the value stored under the key, or the empty string if
+	// there is none.
+	Value(key string) (string, error)
+	// SetValue stores a value under the key.
+	SetValue(key, value string) error
+
+	// RoomSettings returns the settings stored for a room, which override
+	// the room specific configuration.
+	RoomSettings(roomID id.RoomID) (RoomConfig, error)
+
+	// Close flushes and closes the store.
+	Close() error
+}
+
+// memStore is a Store keeping everything in memory, used when no database is
+// configured.
+type memStore struct {
+	mu      sync.RWMutex
+	history map[string][]Record
+	values  map[string]string
+}
+
+// volatile returns whether the state of fallacy is only kept in memory.
+func (b *Bot) volatile() bool {
+	_, ok := b.store.(*memStore)
+	return ok
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		history: make(map[string][]Record),
+		values:  make(map[string]string),
+	}
+}
+
+func (s *memStore) AddRecord(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history[r.Target] = append(s.history[r.Target], r)
+	return nil
+}
+
+func (s *memStore) Ping(context.Context) error {
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// RoomSettings returns no settings as they can't be set at runtime.
+func (s *memStore) RoomSettings(id.RoomID) (RoomConfig, error) {
+	return RoomConfig{}, nil
+}
+
+func (s *memStore) Value(key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values[key], nil
+}
+
+func (s *memStore) SetValue(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	return nil
+}
+
+func (s *memStore) History(user id.UserID, limit int) ([]Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	h := s.history[user.String()]
+	r := make([]Record, len(h))
+	copy(r, h)
+	sort.SliceStable(r, func(i, j int) bool { return r[i].Time.After(r[j].Time) })
+	if limit > 0 && len(r) > limit {
+		r = r[:limit]
+	}
+	return r, nil
+}
+
+// pgSchema is the schema of the Postgres database.
+const pgSchema = `
+CREATE TABLE IF NOT EXISTS history (
+	id           BIGSERIAL PRIMARY KEY,
+	time         TIMESTAMPTZ NOT NULL,
+	kind         TEXT NOT NULL,
+	actor        TEXT NOT NULL,
+	target       TEXT NOT NULL,
+	room_id      TEXT NOT NULL,
+	reason       TEXT NOT NULL,
+	triggered_by TEXT NOT NULL,
+	detail       TEXT NOT NULL,
+	error        TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS history_target_idx ON history (target, time DESC);
+CREATE TABLE IF NOT EXISTS kv (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS room_settings (
+	room_id  TEXT PRIMARY KEY,
+	settings JSONB NOT NULL
+);
+CREATE OR REPLACE FUNCTION notify_room_settings() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('room_settings', COALESCE(NEW.room_id, OLD.room_id));
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS room_settings_notify ON room_settings;
+CREATE TRIGGER room_settings_notify AFTER INSERT OR UPDATE OR DELETE ON room_settings
+	FOR EACH ROW EXECUTE PROCEDURE notify_room_settings();
+`
+
+// pgListenRetry is how long to wait before listening for changes of the room
+// settings again after the connection was lost.
+const pgListenRetry = 10 * time.Second
+
+// pgStore is a Store backed by a Postgres database. The room settings are
+// cached while the changes notified by the trigger of their table are
+// listened for.
+type pgStore struct {
+	pool   *pgxpool.Pool
+	logger *slog.Logger
+
+	// cancel stops listening, done is closed once the listener returned
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// mutex protecting the fields below
+	mu sync.Mutex
+	// the settings of rooms fetched so far
+	rooms map[id.RoomID]RoomConfig
+	// whether changes are listened for, settings are only cached then
+	listening bool
+	// gen counts the changes, settings fetched before one aren't cached
+	gen uint64
+}
+
+// newPgStore connects to the Postgres database at the connection string and
+// creates the schema.
+func newPgStore(conn string, logger *slog.Logger) (*pgStore, error) {
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, pgSchema); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &pgStore{
+		pool:   pool,
+		logger: logger,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		rooms:  make(map[id.RoomID]RoomConfig),
+	}
+	go s.listen(ctx)
+	return s, nil
+}
+
+// listen keeps the cached room settings up to date until the context is
+// canceled, listening again after pgListenRetry if the connection is lost.
+func (s *pgStore) listen(ctx context.Context) {
+	defer close(s.done)
+	for {
+		err := s.listenConn(ctx)
+		s.reset(false)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Error("listening for room settings changes failed", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pgListenRetry):
+		}
+	}
+}
+
+// listenConn listens for changes of the room settings on a connection of its
+// own, forgetting the changed settings until the connection fails.
+func (s *pgStore) listenConn(ctx context.Context) error {
+	conn, err := pgx.ConnectConfig(ctx, s.pool.Config().ConnConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN room_settings"); err != nil {
+		return err
+	}
+	s.reset(true)
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		s.forget(id.RoomID(n.Payload))
+	}
+}
+
+// reset empties the cache of room settings, which is only used while
+// listening.
+func (s *pgStore) reset(listening bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms = make(map[id.RoomID]RoomConfig)
+	s.listening = listening
+	s.gen++
+}
+
+// forget removes the changed settings of a room from the cache.
+func (s *pgStore) forget(roomID id.RoomID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rooms, roomID)
+	s.gen++
+}
+
+func (s *pgStore) AddRecord(r Record) error {
+	_, err := s.pool.Exec(context.Background(), `INSERT INTO history
+		(time, kind, actor, target, room_id, reason, triggered_by, detail, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		r.Time, r.Kind, r.Actor.String(), r.Target, r.RoomID.String(), r.Reason,
+		string(r.Trigger), r.Detail, r.Error)
+	return err
+}
+
+func (s *pgStore) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+func (s *pgStore) Close() error {
+	s.cancel()
+	<-s.done
+	s.pool.Close()
+	return nil
+}
+
+func (s *pgStore) Value(key string) (value string, err error) {
+	err = s.pool.QueryRow(context.Background(),
+		"SELECT value FROM kv WHERE key = $1", key).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (s *pgStore) SetValue(key, value string) error {
+	_, err := s.pool.Exec(context.Background(), `INSERT INTO kv (key, value)
+		VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+// RoomSettings returns the settings of the room, querying them only if they
+// aren't cached.
+func (s *pgStore) RoomSettings(roomID id.RoomID) (RoomConfig, error) {
+	s.mu.Lock()
+	c, ok := s.rooms[roomID]
+	gen := s.gen
+	s.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	err := s.pool.QueryRow(context.Background(),
+		"SELECT settings FROM room_settings WHERE room_id = $1", roomID.String()).Scan(&c)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = nil
+	}
+	if err != nil {
+		return RoomConfig{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// settings changed in the meantime might be stale
+	if s.listening && s.gen == gen {
+		s.rooms[roomID] = c
+	}
+	return c, nil
+}
+
+func (s *pgStore) History(user id.UserID, limit int) ([]Record, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.pool.Query(context.Background(), `SELECT
+		time, kind, actor, target, room_id, reason, triggered_by, detail, error
+		FROM history WHERE target = $1 ORDER BY time DESC
+		LIMIT NULLIF($2, -1)`, user.String(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var (
+			r                        Record
+			actor, room, triggeredBy string
+		)
+		if err := rows.Scan(&r.Time, &r.Kind, &actor, &r.Target, &room, &r.Reason,
+			&triggeredBy, &r.Detail, &r.Error); err != nil {
+			return nil, err
+		}
+		r.Actor, r.RoomID, r.Trigger = id.UserID(actor), id.RoomID(room), Trigger(triggeredBy)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// storer is a mautrix.Storer persisting the filter ID in the store and loading
+// the sync token saved by the syncer, so syncing resumes where it left off
+// after a restart. Rooms and the current sync token are kept in memory.
+type storer struct {
+	*mautrix.InMemoryStore
+	bot *Bot
+	// mutex guarding the sync token, which is read outside of the sync
+	mu *sync.Mutex
+}
+
+func newStorer(b *Bot) storer {
+	return storer{mautrix.NewInMemoryStore(), b, new(sync.Mutex)}
+}
+
+// filterKey returns the key of the filter ID of the user. The key includes a
+// hash of the filter so a changed filter is uploaded again.
+func (s storer) filterKey(userID id.UserID) string {
+	f, _ := json.Marshal(s.bot.Client.Syncer.GetFilterJSON(userID))
+	sum := sha256.Sum256(f)
+	return "filter_id/" + userID.String() + "/" + hex.EncodeToString(sum[:8])
+}
+
+func nextBatchKey(userID id.UserID) string {
+	return "next_batch/" + userID.String()
+}
+
+// load returns the value of the key, logging errors.
+func (s storer) load(key string) string {
+	v, err := s.bot.store.Value(key)
+	if err != nil {
+		s.bot.logger.Error("loading sync state failed", "key", key, "error", err)
+	}
+	return v
+}
+
+// save stores the value under the key, logging errors.
+func (s storer) save(key, value string) {
+	if err := s.bot.store.SetValue(key, value); err != nil {
+		s.bot.logger.Error("saving sync state failed", "key", key, "error", err)
+	}
+}
+
+func (s storer) SaveFilterID(userID id.UserID, filterID string) {
+	s.save(s.filterKey(userID), filterID)
+}
+
+func (s storer) LoadFilterID(userID id.UserID) string {
+	return s.load(s.filterKey(userID))
+}
+
+// SaveNextBatch keeps the sync token in memory, the syncer saves it in the
+// store once the events of the response have been handled.
+func (s storer) SaveNextBatch(userID id.UserID, nextBatchToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.InMemoryStore.SaveNextBatch(userID, nextBatchToken)
+}
+
+func (s storer) LoadNextBatch(userID id.UserID) string {
+	s.mu.Lock()
+	t := s.InMemoryStore.LoadNextBatch(userID)
+	s.mu.Unlock()
+	if t != "" {
+		return t
+	}
+	return s.load(nextBatchKey(userID))
+}
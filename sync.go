@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"runtime/debug"
+	"sync"
 	"time"
 
 	"maunium.net/go/mautrix"
@@ -18,6 +19,8 @@ import (
 )
 
 type Syncer struct {
+	bot *Bot
+
 	globalListeners []mautrix.EventHandler
 	// listeners want a specific event type
 	listeners map[event.Type][]mautrix.EventHandler
@@ -27,20 +30,46 @@ type Syncer struct {
 	// If it returns false, the event will not be forwarded to listeners.
 	ParseErrorHandler func(ev *event.Event, err error) bool
 	syncListeners     []mautrix.SyncHandler
+	// whether the first sync has been caught up on
+	caughtUp bool
+
+	// mutex protecting batches and their pending events
+	mu sync.Mutex
+	// the sync responses whose tokens aren't saved yet, oldest first
+	batches []*batch
 }
 
-func NewSyncer() *Syncer {
-	return &Syncer{
+// batch is a sync response whose events are being handled. Its token is saved
+// once its events and those of the earlier responses have been handled, so
+// events still waiting for their listeners are synced again after a restart.
+type batch struct {
+	s     *Syncer
+	token string
+	// whether the response carries nothing for fallacy, see quiet
+	quiet bool
+	// the events waiting for their listeners, plus one until every event of
+	// the response has been dispatched
+	pending int
+}
+
+func (b *Bot) NewSyncer() *Syncer {
+	s := &Syncer{
+		bot:               b,
 		listeners:         make(map[event.Type][]mautrix.EventHandler),
 		ParseEventContent: true,
 		ParseErrorHandler: func(evt *event.Event, err error) bool {
 			return false
 		},
 	}
+	s.OnSync(b.cryptoSync)
+	s.OnSync(s.catchUp)
+	s.OnEventType(roomSettingsType, b.handleRoomSettings)
+	return s
 }
 
 // ProcessResponse processes the /sync response in a way suitable for bots. "Suitable for bots" means a stream of
-// unrepeating events. Returns a fatal error if a listener panics.
+// unrepeating events. Returns a fatal error if a sync listener panics, panics of
+// event listeners are recovered by the workers calling them.
 func (s *Syncer) ProcessResponse(res *mautrix.RespSync, since string) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -48,26 +77,62 @@ func (s *Syncer) ProcessResponse(res *mautrix.RespSync, since string) (err error
 		}
 	}()
 
+	// the batch is dropped, but it is only received while shutting down if
+	// the sync completed right before it was canceled
+	if !s.bot.begin() {
+		return
+	}
+	defer s.bot.end()
+
+	start := time.Now()
+	defer func() { syncProcessSeconds.Observe(time.Since(start).Seconds()) }()
+
+	// every sync listener sees the response, even if an earlier one asked for
+	// its events to be skipped
+	skip := false
 	for _, listener := range s.syncListeners {
 		if !listener(res, since) {
-			return
+			skip = true
 		}
 	}
 
+	s.bot.setSynced()
+	bt := s.startBatch(res)
+	if skip {
+		bt.release()
+		return
+	}
+
+	s.processSyncEvents("", res.Presence.Events, mautrix.EventSourcePresence, bt)
+	s.processSyncEvents("", res.AccountData.Events, mautrix.EventSourceAccountData, bt)
+	s.processSyncEvents("", res.ToDevice.Events, mautrix.EventSourceToDevice, bt)
+
 	for roomID, roomData := range res.Rooms.Join {
-		s.processSyncEvents(roomID, roomData.State.Events, mautrix.EventSourceJoin|mautrix.EventSourceState)
-		s.processSyncEvents(roomID, roomData.Timeline.Events, mautrix.EventSourceJoin|mautrix.EventSourceTimeline)
+		s.processSyncEvents(roomID, roomData.State.Events, mautrix.EventSourceJoin|mautrix.EventSourceState, bt)
+		s.processSyncEvents(roomID, roomData.Timeline.Events, mautrix.EventSourceJoin|mautrix.EventSourceTimeline, bt)
+		s.processSyncEvents(roomID, roomData.Ephemeral.Events, mautrix.EventSourceJoin|mautrix.EventSourceEphemeral, bt)
+		s.processSyncEvents(roomID, roomData.AccountData.Events, mautrix.EventSourceJoin|mautrix.EventSourceAccountData, bt)
+	}
+	for roomID, roomData := range res.Rooms.Invite {
+		s.processSyncEvents(roomID, roomData.State.Events, mautrix.EventSourceInvite|mautrix.EventSourceState, bt)
 	}
+	for roomID, roomData := range res.Rooms.Leave {
+		s.processSyncEvents(roomID, roomData.State.Events, mautrix.EventSourceLeave|mautrix.EventSourceState, bt)
+		s.processSyncEvents(roomID, roomData.Timeline.Events, mautrix.EventSourceLeave|mautrix.EventSourceTimeline, bt)
+	}
+	bt.release()
 	return
 }
 
-func (s *Syncer) processSyncEvents(roomID id.RoomID, events []*event.Event, source mautrix.EventSource) {
+func (s *Syncer) processSyncEvents(roomID id.RoomID, events []*event.Event, source mautrix.EventSource, bt *batch) {
 	for _, evt := range events {
-		s.processSyncEvent(roomID, evt, source)
+		s.processSyncEvent(roomID, evt, source, bt)
 	}
 }
 
-func (s *Syncer) processSyncEvent(roomID id.RoomID, evt *event.Event, source mautrix.EventSource) {
+// processSyncEvent passes an event of the sync response bt to its listeners.
+// Events not received through a sync have no response.
+func (s *Syncer) processSyncEvent(roomID id.RoomID, evt *event.Event, source mautrix.EventSource, bt *batch) {
 	evt.RoomID = roomID
 
 	// Ensure the type class is correct. It's safe to mutate the class since the event type is not a pointer.
@@ -84,23 +149,33 @@ func (s *Syncer) processSyncEvent(roomID id.RoomID, evt *event.Event, source mau
 	default:
 		evt.Type.Class = event.MessageEventType
 	}
+	eventsProcessed.WithLabelValues(typeLabel(evt.Type)).Inc()
 
 	if s.ParseEventContent {
 		err := evt.Content.ParseRaw(evt.Type)
 		if err != nil && !s.ParseErrorHandler(evt, err) {
 			return
 		}
+
+		dec, err := s.bot.cryptoEvent(evt)
+		if err != nil {
+			s.bot.eventLogger(evt).Warn("decrypting event failed", "error", err)
+			return
+		}
+		evt = dec
 	}
 
-	s.notifyListeners(source, evt)
+	s.notifyListeners(source, evt, bt)
 }
 
-func (s *Syncer) notifyListeners(source mautrix.EventSource, evt *event.Event) {
-	listeners, exists := s.listeners[evt.Type]
-	if exists {
-		for _, fn := range listeners {
-			go fn(source, evt)
-		}
+// notifyListeners queues an event for the global listeners and the listeners
+// of its type, which are called in the order the events of its room arrived.
+func (s *Syncer) notifyListeners(source mautrix.EventSource, evt *event.Event, bt *batch) {
+	var listeners []mautrix.EventHandler
+	listeners = append(listeners, s.globalListeners...)
+	listeners = append(listeners, s.listeners[evt.Type]...)
+	if len(listeners) > 0 {
+		s.bot.dispatch(source, evt, listeners, bt)
 	}
 }
 
@@ -111,34 +186,110 @@ func (s *Syncer) OnEventType(eventType event.Type, callback mautrix.EventHandler
 	if !exists {
 		s.listeners[eventType] = []mautrix.EventHandler{}
 	}
-	s.listeners[eventType] = append(s.listeners[eventType], callback)
+	s.listeners[eventType] = append(s.listeners[eventType], s.bot.protected(callback))
 }
 
+// OnSync allows callers to be notified of every /sync response before its
+// events are dispatched. Every callback is called; if any returns false, the
+// events of the response are not dispatched.
 func (s *Syncer) OnSync(callback mautrix.SyncHandler) {
 	s.syncListeners = append(s.syncListeners, callback)
 }
 
+// quiet returns whether a sync response carries nothing for fallacy, like the
+// responses woken up by fallacy writing its own account data.
+func quiet(res *mautrix.RespSync) bool {
+	return len(res.Rooms.Join) == 0 && len(res.Rooms.Invite) == 0 && len(res.Rooms.Leave) == 0 &&
+		len(res.AccountData.Events) == 0 && len(res.ToDevice.Events) == 0 &&
+		len(res.Presence.Events) == 0 && len(res.DeviceLists.Changed) == 0 && len(res.DeviceLists.Left) == 0
+}
+
+// startBatch starts tracking the events of a sync response, which must be
+// released once they have all been dispatched.
+func (s *Syncer) startBatch(res *mautrix.RespSync) *batch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bt := &batch{s: s, token: res.NextBatch, quiet: quiet(res), pending: 1}
+	s.batches = append(s.batches, bt)
+	return bt
+}
+
+// add counts an event of the batch waiting for its listeners.
+func (bt *batch) add() {
+	if bt == nil {
+		return
+	}
+	bt.s.mu.Lock()
+	defer bt.s.mu.Unlock()
+	bt.pending++
+}
+
+// release marks an event of the batch as handled, or the batch as dispatched.
+// Once the batch and those before it are done, the token of the latest is
+// saved in the store. The tokens of quiet responses are only kept in memory,
+// as saving them would write the account data store again, waking up the sync
+// once more.
+func (bt *batch) release() {
+	if bt == nil {
+		return
+	}
+	s := bt.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bt.pending--
+	var token string
+	save := false
+	for len(s.batches) > 0 && s.batches[0].pending == 0 {
+		token = s.batches[0].token
+		save = save || !s.batches[0].quiet
+		s.batches = s.batches[1:]
+	}
+	if !save {
+		return
+	}
+	// saved with the lock held so tokens are never saved out of order
+	if err := s.bot.store.SetValue(nextBatchKey(s.bot.Client.UserID), token); err != nil {
+		s.bot.logger.Error("saving sync token failed", "error", err)
+	}
+}
+
+// OnEvent allows callers to be notified of every event, regardless of its
+// type.
 func (s *Syncer) OnEvent(callback mautrix.EventHandler) {
-	s.globalListeners = append(s.globalListeners, callback)
+	s.globalListeners = append(s.globalListeners, s.bot.protected(callback))
 }
 
 // OnFailedSync always returns a 10 second wait period between failed /syncs, never a fatal error.
+// Invalidated sessions are restored by logging in again.
 func (s *Syncer) OnFailedSync(res *mautrix.RespSync, err error) (time.Duration, error) {
+	syncFailures.Inc()
+	if isLoggedOut(err) {
+		s.bot.setLoggedIn(false)
+		s.bot.logger.Warn("session was invalidated, logging in again")
+		if err := s.bot.relogin(); err != nil {
+			s.bot.logger.Error("logging in again failed", "error", err)
+			return 10 * time.Second, nil
+		}
+		s.bot.setLoggedIn(true)
+		return 0, nil
+	}
 	return 10 * time.Second, nil
 }
 
 func (s *Syncer) GetFilterJSON(id.UserID) *mautrix.Filter {
 	return &mautrix.Filter{
+		// the state kept by the account data store is only read on start
+		AccountData: mautrix.FilterPart{
+			NotTypes: []event.Type{
+				{Type: accountStateType, Class: event.AccountDataEventType},
+				{Type: accountHistoryType, Class: event.AccountDataEventType},
+			},
+		},
 		Room: mautrix.RoomFilter{
-			Rooms: permittedRooms,
+			Rooms: s.bot.permittedRooms,
 			Timeline: mautrix.FilterPart{
-				Types: []event.Type{
-					event.EventMessage,
-					event.StateMember,
-					event.StatePolicyServer,
-					event.StatePolicyUser,
-					event.StateTombstone,
-				},
+				Types: timelineTypes,
 			},
 		},
 	}
@@ -0,0 +1,54 @@
+// Copyright 2021 The fallacy Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fallacy
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// response returns a sync response with the token, carrying a room unless it
+// is quiet.
+func response(token string, quiet bool) *mautrix.RespSync {
+	res := &mautrix.RespSync{NextBatch: token}
+	if !quiet {
+		res.Rooms.Join = map[id.RoomID]mautrix.SyncJoinedRoom{"!room:example.org": {}}
+	}
+	return res
+}
+
+func TestBatchSavesToken(t *testing.T) {
+	b := newBot()
+	b.Client = &mautrix.Client{UserID: "@fallacy:example.org"}
+	s := b.NewSyncer()
+	saved := func() string {
+		v, _ := b.store.Value(nextBatchKey(b.Client.UserID))
+		return v
+	}
+
+	// the first response has an event still waiting for its listeners when
+	// the second one is done
+	first := s.startBatch(response("1", false))
+	first.add()
+	first.release()
+	second := s.startBatch(response("2", false))
+	second.release()
+	if got := saved(); got != "" {
+		t.Fatalf("saved token %q before the events of the first response were handled", got)
+	}
+
+	first.release()
+	if got := saved(); got != "2" {
+		t.Errorf("saved token = %q, want %q", got, "2")
+	}
+
+	// the tokens of quiet responses are only kept in memory
+	s.startBatch(response("3", true)).release()
+	if got := saved(); got != "2" {
+		t.Errorf("saved token after a quiet response = %q, want %q", got, "2")
+	}
+}